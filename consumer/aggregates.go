@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// aggregate is a table of daily rollups derived from the typed tables.
+// Rather than being rebuilt from scratch, it's recomputed for only the days
+// that a page of events could have changed.
+type aggregate struct {
+	Name string
+
+	// Delete and Insert recompute the aggregate for the days in $2 (an array
+	// of dates) of the account in $1. Both are NULL when refreshing every day
+	// of every account.
+	Delete string
+	Insert string
+}
+
+var aggregates = []*aggregate{
+	{
+		// Charges are counted on the day that they were made, and refunds
+		// and lost disputes on the day that they were created. Net volume is
+		// what's left of gross volume after both.
+		Name: "daily_volume",
+		Delete: `
+			DELETE FROM daily_volume
+			WHERE ($1::text IS NULL OR account_id = $1)
+				AND ($2::date[] IS NULL OR day = ANY($2))`,
+		Insert: `
+			INSERT INTO daily_volume (account_id, day, currency,
+				gross_amount, charge_count,
+				refunded_amount, refund_count,
+				disputed_amount, dispute_count,
+				net_amount)
+			SELECT account_id, day, currency,
+				sum(gross_amount), sum(charge_count),
+				sum(refunded_amount), sum(refund_count),
+				sum(disputed_amount), sum(dispute_count),
+				sum(gross_amount) - sum(refunded_amount) - sum(disputed_amount)
+			FROM (
+				SELECT account_id, (created AT TIME ZONE 'UTC')::date AS day, currency,
+					amount AS gross_amount, 1 AS charge_count,
+					0 AS refunded_amount, 0 AS refund_count,
+					0 AS disputed_amount, 0 AS dispute_count
+				FROM charges
+				WHERE status = 'succeeded'
+
+				UNION ALL
+
+				SELECT account_id, (created AT TIME ZONE 'UTC')::date, currency,
+					0, 0, amount, 1, 0, 0
+				FROM charge_refunds
+
+				UNION ALL
+
+				SELECT account_id, (created AT TIME ZONE 'UTC')::date, currency,
+					0, 0, 0, 0, amount, 1
+				FROM disputes
+				WHERE status = 'lost'
+			) volume
+			WHERE ($1::text IS NULL OR account_id = $1)
+				AND ($2::date[] IS NULL OR day = ANY($2))
+			GROUP BY account_id, day, currency`,
+	},
+	{
+		// Every version of a subscription in its history is a potential
+		// movement in MRR, on the day that it became valid. A subscription
+		// contributes MRR while it's active or past due, normalized from its
+		// plan's interval to a month. Summing net_mrr up to a day gives the
+		// MRR on that day.
+		Name: "daily_mrr_movements",
+		Delete: `
+			DELETE FROM daily_mrr_movements
+			WHERE ($1::text IS NULL OR account_id = $1)
+				AND ($2::date[] IS NULL OR day = ANY($2))`,
+		Insert: `
+			INSERT INTO daily_mrr_movements (account_id, day, currency,
+				new_mrr, expansion_mrr, contraction_mrr, churned_mrr, net_mrr)
+			SELECT account_id, day, currency,
+				sum(CASE WHEN previous_mrr = 0 AND mrr > 0 THEN mrr ELSE 0 END),
+				sum(CASE WHEN previous_mrr > 0 AND mrr > previous_mrr THEN mrr - previous_mrr ELSE 0 END),
+				sum(CASE WHEN mrr > 0 AND mrr < previous_mrr THEN previous_mrr - mrr ELSE 0 END),
+				sum(CASE WHEN previous_mrr > 0 AND mrr = 0 THEN previous_mrr ELSE 0 END),
+				sum(mrr - previous_mrr)
+			FROM (
+				SELECT account_id, day, currency, mrr,
+					coalesce(lag(mrr) OVER (PARTITION BY account_id, id
+						ORDER BY valid_from_sequence), 0) AS previous_mrr
+				FROM (
+					SELECT account_id, id, valid_from_sequence,
+						(valid_from AT TIME ZONE 'UTC')::date AS day,
+						plan_currency AS currency,
+						CASE WHEN status IN ('active', 'past_due') THEN
+							plan_amount * quantity * CASE plan_interval
+								WHEN 'day' THEN 365.0 / 12
+								WHEN 'week' THEN 52.0 / 12
+								WHEN 'month' THEN 1.0
+								WHEN 'year' THEN 1.0 / 12
+							END / plan_interval_count
+						ELSE 0 END AS mrr
+					FROM subscriptions_history
+					WHERE ($1::text IS NULL OR account_id = $1)
+						AND ($2::date[] IS NULL OR id IN (
+							SELECT id
+							FROM subscriptions_history
+							WHERE account_id = $1
+								AND (valid_from AT TIME ZONE 'UTC')::date = ANY($2)
+						))
+				) versions
+			) movements
+			WHERE ($2::date[] IS NULL OR day = ANY($2))
+			GROUP BY account_id, day, currency
+			HAVING sum(abs(mrr - previous_mrr)) > 0`,
+	},
+}
+
+// touchedDays is the set of days of each account whose aggregates need to
+// be recomputed.
+type touchedDays map[string]map[time.Time]bool
+
+func (t touchedDays) add(account string, day time.Time) {
+	if t[account] == nil {
+		t[account] = make(map[time.Time]bool)
+	}
+	t[account][day] = true
+}
+
+// Adds the days that rows written to a table could have changed the
+// aggregates of. Deletions carry no values, so the days that they change are
+// those of the stored rows, which are added by addStoredRows.
+func (t touchedDays) addRows(table *Table, rows []Row) {
+	for _, row := range rows {
+		if row.Deleted {
+			continue
+		}
+
+		for _, day := range aggregateDays(table, row) {
+			t.add(row.Event.Account, day)
+		}
+	}
+}
+
+// Adds the days of the rows currently stored for the objects that rows are
+// about to replace or delete, along with those of their child rows, so that
+// the aggregates of days that an object or a child row moves away from or
+// disappears from are recomputed too. It has to be called before the rows
+// are written.
+//
+// Subscriptions are left out because MRR is derived from their history,
+// whose earlier versions are never changed.
+func (t touchedDays) addStoredRows(tx *sql.Tx, table *Table, rows []Row) error {
+	if len(rows) == 0 || (table.Name != "charges" && table.Name != "disputes") {
+		return nil
+	}
+
+	accountIndex := columnIndex(table, "account_id")
+	idIndex := columnIndex(table, "id")
+
+	var accounts, ids []string
+	for _, row := range rows {
+		accounts = append(accounts, row.Values[accountIndex].(string))
+		ids = append(ids, row.Values[idIndex].(string))
+	}
+
+	queries := []string{fmt.Sprintf(`
+		SELECT account_id, created FROM %s
+		WHERE (account_id, id) IN (SELECT * FROM unnest($1::text[], $2::text[]))`,
+		table.Name)}
+	for _, child := range table.Children {
+		queries = append(queries, fmt.Sprintf(`
+			SELECT account_id, created FROM %s
+			WHERE (%s, %s) IN (SELECT * FROM unnest($1::text[], $2::text[]))`,
+			child.Name, child.ParentKey[0], child.ParentKey[1]))
+	}
+
+	for _, query := range queries {
+		stored, err := tx.Query(query, pq.Array(accounts), pq.Array(ids))
+		if err != nil {
+			return err
+		}
+
+		for stored.Next() {
+			var account string
+			var created time.Time
+			err = stored.Scan(&account, &created)
+			if err != nil {
+				stored.Close()
+				return err
+			}
+			t.add(account, utcDay(created))
+		}
+		err = stored.Close()
+		if err != nil {
+			return err
+		}
+		if err = stored.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the days whose aggregates a row could change. Only the tables that
+// aggregates are derived from touch any days.
+func aggregateDays(table *Table, row Row) []time.Time {
+	var days []time.Time
+	switch table.Name {
+	case "charges":
+		days = append(days, utcDay(row.Values[columnIndex(table, "created")]))
+		for _, child := range table.Children {
+			for _, values := range row.Children[child] {
+				days = append(days, utcDay(values[columnIndex(child, "created")]))
+			}
+		}
+
+	case "disputes":
+		days = append(days, utcDay(row.Values[columnIndex(table, "created")]))
+
+	// A new version of a subscription becomes valid when the event that
+	// produced it was created.
+	case "subscriptions":
+		days = append(days, utcDay(time.Unix(row.Event.Created, 0)))
+	}
+	return days
+}
+
+func utcDay(value interface{}) time.Time {
+	t := value.(time.Time).UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Recomputes every aggregate for the days that have been touched.
+func refreshAggregates(tx *sql.Tx, touched touchedDays) error {
+	for account, days := range touched {
+		var dates []string
+		for day := range days {
+			dates = append(dates, day.Format("2006-01-02"))
+		}
+		sort.Strings(dates)
+
+		for _, aggregate := range aggregates {
+			for _, query := range []string{aggregate.Delete, aggregate.Insert} {
+				_, err := tx.Exec(query, account, pq.Array(dates))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Recomputes every aggregate from scratch. This is needed after aggregates
+// are first enabled, or after a table that they're derived from has been
+// rebuilt.
+func refreshAllAggregates(db *sql.DB) error {
+	start := time.Now()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, aggregate := range aggregates {
+		for _, query := range []string{aggregate.Delete, aggregate.Insert} {
+			_, err := tx.Exec(query, nil, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Refreshed %v aggregate(s) in %v.", len(aggregates), time.Now().Sub(start))
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Currencies whose amounts Stripe gives in whole units rather than in
+// hundredths, so that 100 JPY is sent as 100 rather than 10000. This is the
+// only copy of the list: Postgres' `decimal_amount` reads it from the
+// `zero_decimal_currencies` table, which is synced from here on every
+// migration.
+var zeroDecimalCurrencies = map[string]bool{
+	"bif": true,
+	"clp": true,
+	"djf": true,
+	"gnf": true,
+	"jpy": true,
+	"kmf": true,
+	"krw": true,
+	"mga": true,
+	"pyg": true,
+	"rwf": true,
+	"ugx": true,
+	"vnd": true,
+	"vuv": true,
+	"xaf": true,
+	"xof": true,
+	"xpf": true,
+}
+
+// Converts an amount in the smallest unit of its currency to an exact
+// decimal amount in the currency's main unit (e.g. cents to dollars).
+func decimalAmount(amount int64, currency string) *big.Rat {
+	if zeroDecimalCurrencies[strings.ToLower(currency)] {
+		return big.NewRat(amount, 1)
+	}
+	return big.NewRat(amount, 100)
+}
+
+// fxRate is the value of a unit of a currency in USD on a date. Rates are
+// kept exactly as they were given rather than as floats so that converted
+// amounts are exact before they're rounded.
+type fxRate struct {
+	Date time.Time
+	Rate *big.Rat
+
+	// Text is the rate as it was written in the file.
+	Text string
+}
+
+// FXRates holds exchange rates to USD by currency and date.
+type FXRates struct {
+	// Rates for each currency in order of date.
+	rates map[string][]fxRate
+}
+
+// The rates used to populate USD amounts, or nil if none were loaded, in
+// which case USD amounts are left NULL. Set at startup before any events are
+// mapped.
+var fxRates *FXRates
+
+// Loads exchange rates from a CSV file with a header row and the columns
+// `date` (like 2016-02-04), `currency`, and `rate`, where rate is the value
+// of one unit of the currency in USD.
+func loadFXRates(path string) (*FXRates, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 3
+
+	rates := &FXRates{rates: make(map[string][]fxRate)}
+	numRates := 0
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if line == 1 {
+			continue
+		}
+
+		date, err := time.Parse("2006-01-02", record[0])
+		if err != nil {
+			return nil, fmt.Errorf("Bad date on line %v of %v: %v", line, path, err)
+		}
+
+		// Only plain decimals are accepted because the text is also what's
+		// written to the `fx_rates` table.
+		text := strings.TrimSpace(record[2])
+		_, err = strconv.ParseFloat(text, 64)
+		rate, ok := new(big.Rat).SetString(text)
+		if err != nil || !ok || strings.ContainsAny(text, "/eE") {
+			return nil, fmt.Errorf("Bad rate on line %v of %v: %v", line, path, record[2])
+		}
+
+		currency := strings.ToLower(record[1])
+		rates.rates[currency] = append(rates.rates[currency],
+			fxRate{Date: date, Rate: rate, Text: text})
+		numRates++
+	}
+
+	for _, currencyRates := range rates.rates {
+		sort.Slice(currencyRates, func(i, j int) bool {
+			return currencyRates[i].Date.Before(currencyRates[j].Date)
+		})
+	}
+
+	log.Printf("Loaded %v exchange rate(s) for %v currencies.", numRates, len(rates.rates))
+	return rates, nil
+}
+
+// Rate returns the value of one unit of a currency in USD on the date of t.
+// Rates aren't published for every day (like on weekends), so if there's no
+// rate for that date, the latest one before it is used. It returns false if
+// there's no rate on or before the date.
+func (r *FXRates) Rate(currency string, t time.Time) (*big.Rat, bool) {
+	currency = strings.ToLower(currency)
+	if currency == "usd" {
+		return big.NewRat(1, 1), true
+	}
+
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	currencyRates := r.rates[currency]
+	i := sort.Search(len(currencyRates), func(i int) bool {
+		return currencyRates[i].Date.After(day)
+	})
+	if i == 0 {
+		return nil, false
+	}
+	return currencyRates[i-1].Rate, true
+}
+
+// Returns an amount in the smallest unit of its currency converted to USD
+// and rounded to the cent (halves away from zero) as a decimal string, or nil
+// so that it's stored as NULL if there's no rate for the currency on the
+// date. The conversion is done exactly so that no float rounding error can
+// tip an amount over to the next cent.
+func amountUSD(amount int64, currency string, created int64) interface{} {
+	if fxRates == nil {
+		return nil
+	}
+
+	rate, ok := fxRates.Rate(currency, time.Unix(created, 0))
+	if !ok {
+		return nil
+	}
+
+	return new(big.Rat).Mul(decimalAmount(amount, currency), rate).FloatString(2)
+}
+
+// Replaces the contents of the `zero_decimal_currencies` table with
+// zeroDecimalCurrencies. It's safe to run concurrently.
+func writeZeroDecimalCurrencies(db *sql.DB) error {
+	var currencies []string
+	for currency := range zeroDecimalCurrencies {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM zero_decimal_currencies WHERE currency <> ALL($1)`,
+		pq.Array(currencies))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO zero_decimal_currencies (currency)
+		SELECT unnest($1::text[])
+		ON CONFLICT DO NOTHING`,
+		pq.Array(currencies))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Replaces the contents of the `fx_rates` table with rates so that they can be
+// joined against in queries.
+func writeFXRates(db *sql.DB, rates *FXRates) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM fx_rates`)
+	if err != nil {
+		return err
+	}
+
+	statement, err := tx.Prepare(pq.CopyIn("fx_rates", "currency", "date", "rate"))
+	if err != nil {
+		return err
+	}
+
+	for currency, currencyRates := range rates.rates {
+		for _, rate := range currencyRates {
+			_, err = statement.Exec(currency, rate.Date, rate.Text)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = statement.Exec()
+	if err != nil {
+		return err
+	}
+
+	err = statement.Close()
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
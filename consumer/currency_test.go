@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAmountUSD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fx_rates.csv")
+	err := ioutil.WriteFile(path, []byte("date,currency,rate\n"+
+		"2017-07-13,eur,1.14\n"+
+		"2017-07-13,jpy,0.008849\n"+
+		"2017-07-13,ugx,0.000276\n"+
+		"2017-07-14,EUR,1.145\n"+
+		"2017-07-14,chf,1.005\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rates, err := loadFXRates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(previous *FXRates) { fxRates = previous }(fxRates)
+	fxRates = rates
+
+	july14 := time.Date(2017, 7, 14, 12, 0, 0, 0, time.UTC).Unix()
+	july12 := time.Date(2017, 7, 12, 12, 0, 0, 0, time.UTC).Unix()
+
+	testCases := []struct {
+		name     string
+		amount   int64
+		currency string
+		created  int64
+		want     interface{}
+	}{
+		{"USD", 1999, "usd", july14, "19.99"},
+		{"ZeroDecimal", 1000, "JPY", july14, "8.85"},
+		{"ZeroDecimalUGX", 50000, "ugx", july14, "13.80"},
+		{"RateOnDate", 1000, "eur", july14, "11.45"},
+		{"RoundedDown", 10, "eur", july14, "0.11"},
+
+		// 1.005 * 100 is 100.49999999999999 as a float64.
+		{"HalfCentRoundedUp", 100, "chf", july14, "1.01"},
+		{"NegativeHalfCentRoundedDown", -100, "chf", july14, "-1.01"},
+		{"NoRateOnOrBeforeDate", 1000, "eur", july12, nil},
+		{"UnknownCurrency", 1000, "gbp", july14, nil},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			got := amountUSD(testCase.amount, testCase.currency, testCase.created)
+			if got != testCase.want {
+				t.Errorf("Expected %v, got %v", testCase.want, got)
+			}
+		})
+	}
+}
+
+func TestLoadFXRatesBadRate(t *testing.T) {
+	for _, rate := range []string{"1/3", "1e-3", "NaN", "lots"} {
+		path := filepath.Join(t.TempDir(), "fx_rates.csv")
+		err := ioutil.WriteFile(path, []byte("date,currency,rate\n2017-07-14,eur,"+rate+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = loadFXRates(path)
+		if err == nil {
+			t.Errorf("Expected rate %q to be rejected", rate)
+		}
+	}
+}
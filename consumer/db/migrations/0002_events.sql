@@ -0,0 +1,20 @@
+--
+-- An append-only archive of every event received from the feed, stored
+-- verbatim so that fields not yet modeled in the typed tables can still be
+-- queried, and so that the typed tables can be re-derived without re-reading
+-- the feed.
+--
+-- Partitions are by month of each event's `created` time and are created on
+-- demand by the consumer as it encounters new months.
+--
+CREATE TABLE events (
+    sequence bigint NOT NULL,
+    id text,
+    type text,
+    created timestamptz NOT NULL,
+    data jsonb NOT NULL,
+
+    PRIMARY KEY (sequence, created)
+) PARTITION BY RANGE (created);
+
+CREATE INDEX events_type_created ON events (type, created);
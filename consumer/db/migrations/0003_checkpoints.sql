@@ -0,0 +1,9 @@
+--
+-- The sequence of the last event that the consumer loaded, which it resumes
+-- from when restarted.
+--
+CREATE TABLE checkpoints (
+    name text PRIMARY KEY,
+    sequence bigint NOT NULL,
+    updated_at timestamptz NOT NULL
+);
@@ -0,0 +1,14 @@
+--
+-- Events that failed to decode or map into the typed tables. Loading
+-- continues past them, and they can be reprocessed after a fix with
+-- `consumer retry-dead-letters`.
+--
+CREATE TABLE dead_letter_events (
+    sequence bigint PRIMARY KEY,
+    id text,
+    type text,
+    error text NOT NULL,
+    data jsonb NOT NULL,
+    attempts int NOT NULL DEFAULT 1,
+    failed_at timestamptz NOT NULL
+);
@@ -0,0 +1,80 @@
+CREATE TABLE customers (
+    id text PRIMARY KEY,
+    created timestamptz,
+    delinquent boolean,
+    description text,
+    email text,
+    sequence bigint
+);
+
+CREATE TABLE subscriptions (
+    id text PRIMARY KEY,
+    canceled_at timestamptz,
+    created timestamptz,
+    customer text,
+    plan_amount bigint,
+    plan_currency text,
+    plan_id text,
+    plan_interval text,
+    plan_interval_count bigint,
+    quantity bigint,
+    status text,
+    sequence bigint
+);
+
+--
+-- Every version of each object in the typed tables, populated when the
+-- consumer runs with HISTORY=true. A version is valid from the event that
+-- produced it until the event that produced the next one, and the current
+-- version has a NULL `valid_to_sequence`.
+--
+CREATE TABLE charges_history (
+    id text NOT NULL,
+    amount bigint,
+    created timestamptz,
+    sequence bigint,
+    valid_from_sequence bigint NOT NULL,
+    valid_to_sequence bigint,
+    valid_from timestamptz NOT NULL,
+    valid_to timestamptz,
+
+    PRIMARY KEY (id, valid_from_sequence)
+);
+
+CREATE TABLE customers_history (
+    id text NOT NULL,
+    created timestamptz,
+    delinquent boolean,
+    description text,
+    email text,
+    sequence bigint,
+    valid_from_sequence bigint NOT NULL,
+    valid_to_sequence bigint,
+    valid_from timestamptz NOT NULL,
+    valid_to timestamptz,
+
+    PRIMARY KEY (id, valid_from_sequence)
+);
+
+CREATE TABLE subscriptions_history (
+    id text NOT NULL,
+    canceled_at timestamptz,
+    created timestamptz,
+    customer text,
+    plan_amount bigint,
+    plan_currency text,
+    plan_id text,
+    plan_interval text,
+    plan_interval_count bigint,
+    quantity bigint,
+    status text,
+    sequence bigint,
+    valid_from_sequence bigint NOT NULL,
+    valid_to_sequence bigint,
+    valid_from timestamptz NOT NULL,
+    valid_to timestamptz,
+
+    PRIMARY KEY (id, valid_from_sequence)
+);
+
+CREATE INDEX subscriptions_history_valid_from ON subscriptions_history (valid_from);
@@ -0,0 +1,73 @@
+CREATE TABLE invoices (
+    id text PRIMARY KEY,
+    amount_due bigint,
+    created timestamptz,
+    customer text,
+    paid boolean,
+    subscription text,
+    total bigint,
+    sequence bigint
+);
+
+CREATE TABLE invoices_history (
+    id text NOT NULL,
+    amount_due bigint,
+    created timestamptz,
+    customer text,
+    paid boolean,
+    subscription text,
+    total bigint,
+    sequence bigint,
+    valid_from_sequence bigint NOT NULL,
+    valid_to_sequence bigint,
+    valid_from timestamptz NOT NULL,
+    valid_to timestamptz,
+
+    PRIMARY KEY (id, valid_from_sequence)
+);
+
+--
+-- Child tables holding the items of lists nested in their parent's objects.
+-- Every time a parent row is written, all of its child rows are replaced.
+--
+-- There are deliberately no foreign key constraints because a table and its
+-- children are swapped in together when rebuilt.
+--
+CREATE TABLE charge_refunds (
+    charge text NOT NULL,
+    id text NOT NULL,
+    amount bigint,
+    created timestamptz,
+    reason text,
+    sequence bigint,
+
+    PRIMARY KEY (charge, id)
+);
+
+CREATE TABLE invoice_lines (
+    invoice text NOT NULL,
+    id text NOT NULL,
+    amount bigint,
+    description text,
+    period_end timestamptz,
+    period_start timestamptz,
+    plan_id text,
+    proration boolean,
+    quantity bigint,
+    subscription text,
+    type text,
+    sequence bigint,
+
+    PRIMARY KEY (invoice, id)
+);
+
+CREATE TABLE subscription_items (
+    subscription text NOT NULL,
+    id text NOT NULL,
+    created timestamptz,
+    plan_id text,
+    quantity bigint,
+    sequence bigint,
+
+    PRIMARY KEY (subscription, id)
+);
@@ -0,0 +1,59 @@
+--
+-- Objects are now tagged with the connected account that they belong to.
+-- Existing rows all came from the platform's own account, which is stored as
+-- an empty string so that it can be part of each primary key.
+--
+ALTER TABLE charges
+    ADD COLUMN account_id text NOT NULL DEFAULT '',
+    DROP CONSTRAINT charges_pkey,
+    ADD PRIMARY KEY (account_id, id);
+
+ALTER TABLE customers
+    ADD COLUMN account_id text NOT NULL DEFAULT '',
+    DROP CONSTRAINT customers_pkey,
+    ADD PRIMARY KEY (account_id, id);
+
+ALTER TABLE invoices
+    ADD COLUMN account_id text NOT NULL DEFAULT '',
+    DROP CONSTRAINT invoices_pkey,
+    ADD PRIMARY KEY (account_id, id);
+
+ALTER TABLE subscriptions
+    ADD COLUMN account_id text NOT NULL DEFAULT '',
+    DROP CONSTRAINT subscriptions_pkey,
+    ADD PRIMARY KEY (account_id, id);
+
+ALTER TABLE charges_history
+    ADD COLUMN account_id text NOT NULL DEFAULT '',
+    DROP CONSTRAINT charges_history_pkey,
+    ADD PRIMARY KEY (account_id, id, valid_from_sequence);
+
+ALTER TABLE customers_history
+    ADD COLUMN account_id text NOT NULL DEFAULT '',
+    DROP CONSTRAINT customers_history_pkey,
+    ADD PRIMARY KEY (account_id, id, valid_from_sequence);
+
+ALTER TABLE invoices_history
+    ADD COLUMN account_id text NOT NULL DEFAULT '',
+    DROP CONSTRAINT invoices_history_pkey,
+    ADD PRIMARY KEY (account_id, id, valid_from_sequence);
+
+ALTER TABLE subscriptions_history
+    ADD COLUMN account_id text NOT NULL DEFAULT '',
+    DROP CONSTRAINT subscriptions_history_pkey,
+    ADD PRIMARY KEY (account_id, id, valid_from_sequence);
+
+ALTER TABLE charge_refunds
+    ADD COLUMN account_id text NOT NULL DEFAULT '',
+    DROP CONSTRAINT charge_refunds_pkey,
+    ADD PRIMARY KEY (account_id, charge, id);
+
+ALTER TABLE invoice_lines
+    ADD COLUMN account_id text NOT NULL DEFAULT '',
+    DROP CONSTRAINT invoice_lines_pkey,
+    ADD PRIMARY KEY (account_id, invoice, id);
+
+ALTER TABLE subscription_items
+    ADD COLUMN account_id text NOT NULL DEFAULT '',
+    DROP CONSTRAINT subscription_items_pkey,
+    ADD PRIMARY KEY (account_id, subscription, id);
@@ -0,0 +1,90 @@
+ALTER TABLE charges
+    ADD COLUMN currency text,
+    ADD COLUMN status text;
+
+ALTER TABLE charges_history
+    ADD COLUMN currency text,
+    ADD COLUMN status text;
+
+ALTER TABLE charge_refunds
+    ADD COLUMN currency text;
+
+CREATE TABLE disputes (
+    account_id text NOT NULL,
+    id text NOT NULL,
+    amount bigint,
+    charge text,
+    created timestamptz,
+    currency text,
+    reason text,
+    status text,
+    sequence bigint,
+
+    PRIMARY KEY (account_id, id)
+);
+
+CREATE TABLE disputes_history (
+    account_id text NOT NULL,
+    id text NOT NULL,
+    amount bigint,
+    charge text,
+    created timestamptz,
+    currency text,
+    reason text,
+    status text,
+    sequence bigint,
+    valid_from_sequence bigint NOT NULL,
+    valid_to_sequence bigint,
+    valid_from timestamptz NOT NULL,
+    valid_to timestamptz,
+
+    PRIMARY KEY (account_id, id, valid_from_sequence)
+);
+
+--
+-- Daily aggregates maintained by the consumer with AGGREGATES=true. Each is
+-- recomputed for just the days touched by a page as it's loaded, and can be
+-- recomputed entirely with `consumer refresh-aggregates`.
+--
+-- Amounts are in the smallest unit of their currency.
+--
+CREATE TABLE daily_volume (
+    account_id text NOT NULL,
+    day date NOT NULL,
+    currency text NOT NULL,
+    gross_amount bigint NOT NULL,
+    charge_count bigint NOT NULL,
+    refunded_amount bigint NOT NULL,
+    refund_count bigint NOT NULL,
+    disputed_amount bigint NOT NULL,
+    dispute_count bigint NOT NULL,
+    net_amount bigint NOT NULL,
+
+    PRIMARY KEY (account_id, day, currency)
+);
+
+CREATE TABLE daily_mrr_movements (
+    account_id text NOT NULL,
+    day date NOT NULL,
+    currency text NOT NULL,
+    new_mrr numeric NOT NULL,
+    expansion_mrr numeric NOT NULL,
+    contraction_mrr numeric NOT NULL,
+    churned_mrr numeric NOT NULL,
+    net_mrr numeric NOT NULL,
+
+    PRIMARY KEY (account_id, day, currency)
+);
+
+--
+-- Support looking up the rows for days of an account when refreshing
+-- aggregates, which work in days in UTC.
+--
+CREATE INDEX charges_account_id_day
+    ON charges (account_id, ((created AT TIME ZONE 'UTC')::date));
+CREATE INDEX charge_refunds_account_id_day
+    ON charge_refunds (account_id, ((created AT TIME ZONE 'UTC')::date));
+CREATE INDEX disputes_account_id_day
+    ON disputes (account_id, ((created AT TIME ZONE 'UTC')::date));
+CREATE INDEX subscriptions_history_account_id_day
+    ON subscriptions_history (account_id, ((valid_from AT TIME ZONE 'UTC')::date));
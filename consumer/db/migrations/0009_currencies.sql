@@ -0,0 +1,39 @@
+ALTER TABLE charges
+    ADD COLUMN amount_usd numeric;
+
+ALTER TABLE charges_history
+    ADD COLUMN amount_usd numeric;
+
+ALTER TABLE invoices
+    ADD COLUMN currency text;
+
+ALTER TABLE invoices_history
+    ADD COLUMN currency text;
+
+ALTER TABLE invoice_lines
+    ADD COLUMN currency text;
+
+--
+-- The value of one unit of each currency in USD by date, loaded from a CSV
+-- file with `consumer load-fx-rates`.
+--
+CREATE TABLE fx_rates (
+    currency text NOT NULL,
+    date date NOT NULL,
+    rate numeric NOT NULL,
+
+    PRIMARY KEY (currency, date)
+);
+
+--
+-- Converts an amount in the smallest unit of its currency to a decimal amount
+-- in the currency's main unit, taking into account currencies like JPY that
+-- have no minor unit.
+--
+CREATE FUNCTION decimal_amount(amount bigint, currency text) RETURNS numeric AS $$
+    SELECT CASE WHEN lower(currency) IN ('bif', 'clp', 'djf', 'gnf', 'jpy',
+            'kmf', 'krw', 'mga', 'pyg', 'rwf', 'vnd', 'vuv', 'xaf', 'xof', 'xpf')
+        THEN amount::numeric
+        ELSE amount / 100.0
+    END
+$$ LANGUAGE SQL IMMUTABLE;
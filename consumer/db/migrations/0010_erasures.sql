@@ -0,0 +1,24 @@
+ALTER TABLE charges
+    ADD COLUMN customer text;
+
+ALTER TABLE charges_history
+    ADD COLUMN customer text;
+
+--
+-- An audit log of customers erased with `consumer erase`. Only IDs are kept,
+-- which are enough to show that an erasure happened without keeping any of
+-- the data that was erased.
+--
+CREATE TABLE erasures (
+    id bigserial PRIMARY KEY,
+    account_id text NOT NULL,
+    customer text NOT NULL,
+    object_ids text[] NOT NULL,
+    tombstones int NOT NULL,
+    rows_deleted bigint NOT NULL,
+    rows_anonymized bigint NOT NULL,
+    events_deleted bigint NOT NULL,
+    erased_at timestamptz NOT NULL
+);
+
+CREATE INDEX erasures_account_id_customer ON erasures (account_id, customer);
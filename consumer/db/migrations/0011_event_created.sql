@@ -0,0 +1,34 @@
+--
+-- The created time of the event that each row came from. Along with
+-- `sequence`, it orders versions of an object so that a version older than
+-- the one already stored is rejected instead of overwriting it.
+--
+ALTER TABLE charges
+    ADD COLUMN event_created timestamptz;
+
+ALTER TABLE charges_history
+    ADD COLUMN event_created timestamptz;
+
+ALTER TABLE customers
+    ADD COLUMN event_created timestamptz;
+
+ALTER TABLE customers_history
+    ADD COLUMN event_created timestamptz;
+
+ALTER TABLE disputes
+    ADD COLUMN event_created timestamptz;
+
+ALTER TABLE disputes_history
+    ADD COLUMN event_created timestamptz;
+
+ALTER TABLE invoices
+    ADD COLUMN event_created timestamptz;
+
+ALTER TABLE invoices_history
+    ADD COLUMN event_created timestamptz;
+
+ALTER TABLE subscriptions
+    ADD COLUMN event_created timestamptz;
+
+ALTER TABLE subscriptions_history
+    ADD COLUMN event_created timestamptz;
@@ -0,0 +1,38 @@
+--
+-- Child rows now reference their parent so that they can never outlive it,
+-- and are deleted along with it. This replaces the arrangement in
+-- 0006_child_tables, which left them out: `consumer rebuild` now recreates
+-- the constraints when it swaps a table and its children in.
+--
+-- Nothing enforced this before, so remove any orphaned child rows first.
+-- They're derived from the event archive and can be rebuilt.
+--
+DELETE FROM charge_refunds c
+WHERE NOT EXISTS (
+    SELECT 1 FROM charges p WHERE p.account_id = c.account_id AND p.id = c.charge
+);
+
+DELETE FROM invoice_lines c
+WHERE NOT EXISTS (
+    SELECT 1 FROM invoices p WHERE p.account_id = c.account_id AND p.id = c.invoice
+);
+
+DELETE FROM subscription_items c
+WHERE NOT EXISTS (
+    SELECT 1 FROM subscriptions p WHERE p.account_id = c.account_id AND p.id = c.subscription
+);
+
+ALTER TABLE charge_refunds
+    ADD CONSTRAINT charge_refunds_charge_fkey
+    FOREIGN KEY (account_id, charge) REFERENCES charges (account_id, id)
+    ON DELETE CASCADE;
+
+ALTER TABLE invoice_lines
+    ADD CONSTRAINT invoice_lines_invoice_fkey
+    FOREIGN KEY (account_id, invoice) REFERENCES invoices (account_id, id)
+    ON DELETE CASCADE;
+
+ALTER TABLE subscription_items
+    ADD CONSTRAINT subscription_items_subscription_fkey
+    FOREIGN KEY (account_id, subscription) REFERENCES subscriptions (account_id, id)
+    ON DELETE CASCADE;
@@ -0,0 +1,16 @@
+--
+-- The latest deletion of each object, by the typed table that modeled it.
+-- The rows of deleted objects are removed, so this is what a write replayed
+-- from before the deletion (say by `retry-dead-letters` or a reread of the
+-- feed) is checked against so that it's rejected as stale rather than
+-- bringing the object back.
+--
+CREATE TABLE deletions (
+    table_name text NOT NULL,
+    account_id text NOT NULL,
+    id text NOT NULL,
+    event_created timestamptz NOT NULL,
+    sequence bigint NOT NULL,
+
+    PRIMARY KEY (table_name, account_id, id)
+);
@@ -0,0 +1,11 @@
+--
+-- `consumer reconcile` reads the tables it checks in chunks ordered by
+-- `id COLLATE "C"` so that they sort the same as IDs compared in Go. The
+-- primary keys use the database's default collation and can't serve that
+-- order, so give each reconciled table an index that can.
+--
+CREATE INDEX charges_account_id_id_c_idx ON charges (account_id, id COLLATE "C");
+CREATE INDEX customers_account_id_id_c_idx ON customers (account_id, id COLLATE "C");
+CREATE INDEX disputes_account_id_id_c_idx ON disputes (account_id, id COLLATE "C");
+CREATE INDEX invoices_account_id_id_c_idx ON invoices (account_id, id COLLATE "C");
+CREATE INDEX subscriptions_account_id_id_c_idx ON subscriptions (account_id, id COLLATE "C");
@@ -0,0 +1,7 @@
+--
+-- `consumer erase` now keeps the archived events of objects that depend on
+-- an erased customer and only clears their references to it, so count those
+-- in the audit log too.
+--
+ALTER TABLE erasures
+    ADD COLUMN references_redacted bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,16 @@
+--
+-- The currencies that have no minor unit, like JPY. The consumer owns the
+-- list and replaces the contents of this table with it after every migration
+-- so that `decimal_amount` never disagrees with it.
+--
+CREATE TABLE zero_decimal_currencies (
+    currency text PRIMARY KEY
+);
+
+CREATE OR REPLACE FUNCTION decimal_amount(amount bigint, currency text) RETURNS numeric AS $$
+    SELECT CASE WHEN EXISTS (SELECT 1 FROM zero_decimal_currencies z
+            WHERE z.currency = lower($2))
+        THEN $1::numeric
+        ELSE $1 / 100.0
+    END
+$$ LANGUAGE SQL STABLE;
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// DeadLetter is an event that couldn't be loaded along with the reason why.
+type DeadLetter struct {
+	Event *Event
+	Err   error
+}
+
+// Writes dead letters to the `dead_letter_events` table. An event that's
+// dead lettered more than once (say because the feed was reread) replaces
+// its previous entry so that the table always reflects the latest failure.
+func writeDeadLetters(tx *sql.Tx, deadLetters []DeadLetter) error {
+	for _, deadLetter := range deadLetters {
+		event := deadLetter.Event
+		log.Printf("Dead lettering event: %v", deadLetter.Err)
+
+		_, err := tx.Exec(`
+			INSERT INTO dead_letter_events
+				(sequence, id, type, error, data, failed_at)
+			VALUES ($1, $2, $3, $4, $5, now())
+			ON CONFLICT (sequence) DO UPDATE SET
+				data = excluded.data,
+				error = excluded.error,
+				failed_at = excluded.failed_at,
+				attempts = dead_letter_events.attempts + 1`,
+			event.Sequence,
+			event.ID,
+			event.Type,
+			deadLetter.Err.Error(),
+			string(event.Raw),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reprocesses every event in the dead letter table, presumably after a fix
+// to decoding or mapping has been deployed. Events that now load are removed
+// from the table, and those that still fail have their error updated.
+func retryDeadLetters(db *sql.DB, history, aggregates bool) error {
+	start := time.Now()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT sequence, data
+		FROM dead_letter_events
+		ORDER BY sequence
+		FOR UPDATE`)
+	if err != nil {
+		return err
+	}
+
+	// Read everything before loading because pq can't start a COPY while a
+	// result set is still open on the same connection.
+	var events []Event
+	for rows.Next() {
+		var data []byte
+		var event Event
+		var sequence int64
+		err = rows.Scan(&sequence, &data)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		err = json.Unmarshal(data, &event)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		// Dead letters may have been written before the current policy
+		// was in place.
+		err = redactEvent(&event)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		event.Sequence = uint64(sequence)
+		events = append(events, event)
+	}
+	err = rows.Close()
+	if err != nil {
+		return err
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	tableRows, deadLetters := mapEvents(events)
+
+	numStale := 0
+	touched := make(touchedDays)
+	for _, table := range tables {
+		if aggregates {
+			err = touched.addStoredRows(tx, table, tableRows[table])
+			if err != nil {
+				return err
+			}
+		}
+
+		tableStale, err := upsertTableRows(tx, table, "", tableRows[table], history)
+		if err != nil {
+			return err
+		}
+		numStale += tableStale
+		touched.addRows(table, tableRows[table])
+	}
+
+	if aggregates {
+		err = refreshAggregates(tx, touched)
+		if err != nil {
+			return err
+		}
+	}
+
+	failed := make(map[uint64]bool)
+	for _, deadLetter := range deadLetters {
+		failed[deadLetter.Event.Sequence] = true
+	}
+
+	for _, event := range events {
+		if failed[event.Sequence] {
+			continue
+		}
+
+		_, err = tx.Exec(`DELETE FROM dead_letter_events WHERE sequence = $1`,
+			event.Sequence)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeDeadLetters(tx, deadLetters)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Retried %v dead letter(s) in %v. %v loaded, %v still failing, "+
+		"%v stale write(s) discarded.",
+		len(events), time.Now().Sub(start),
+		len(events)-len(deadLetters), len(deadLetters), numStale)
+	return nil
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/brandur/stripe-warehouse/envelope"
+)
+
+// FieldType is the type that a field in an object's JSON is expected to have.
+type FieldType int
+
+const (
+	BooleanField FieldType = iota
+	IntegerField
+
+	// ListField is a Stripe list object whose items (in its `data` array) are
+	// each validated against Field.Fields.
+	ListField
+
+	// ObjectField is a nested object whose own fields are validated against
+	// Field.Fields.
+	ObjectField
+
+	StringField
+
+	// TimestampField is an integer number of seconds since the Unix epoch.
+	TimestampField
+)
+
+func (t FieldType) String() string {
+	switch t {
+	case BooleanField:
+		return "boolean"
+	case IntegerField:
+		return "integer"
+	case ListField:
+		return "list"
+	case ObjectField:
+		return "object"
+	case StringField:
+		return "string"
+	case TimestampField:
+		return "timestamp"
+	}
+	return "unknown"
+}
+
+// Field declares a single field of an object's schema.
+type Field struct {
+	Name     string
+	Type     FieldType
+	Required bool
+
+	// Fields is the schema of a nested object, or of each item in a nested
+	// list. Only used with ObjectField and ListField.
+	Fields []Field
+}
+
+// ObjectType is a type of Stripe object that the consumer knows how to
+// decode.
+type ObjectType struct {
+	// Schema is validated against an object's JSON before it's decoded so that
+	// a problem is reported field by field rather than as an opaque decoding
+	// error (or worse, silently as a zero value).
+	Schema []Field
+
+	// New returns a pointer to a typed struct that the object's JSON will be
+	// decoded into.
+	New func() interface{}
+}
+
+// Charge is a decoded charge object. Amounts are integers in the smallest
+// unit of their currency, so they're kept as integers end to end.
+type Charge struct {
+	Amount   int64       `json:"amount"`
+	Created  int64       `json:"created"`
+	Currency string      `json:"currency"`
+	Customer string      `json:"customer"`
+	ID       string      `json:"id"`
+	Refunds  *RefundList `json:"refunds"`
+	Status   string      `json:"status"`
+}
+
+// Customer is a decoded customer object.
+type Customer struct {
+	Created     int64  `json:"created"`
+	Delinquent  bool   `json:"delinquent"`
+	Description string `json:"description"`
+	Email       string `json:"email"`
+	ID          string `json:"id"`
+}
+
+// Dispute is a decoded dispute object.
+type Dispute struct {
+	Amount   int64  `json:"amount"`
+	Charge   string `json:"charge"`
+	Created  int64  `json:"created"`
+	Currency string `json:"currency"`
+	ID       string `json:"id"`
+	Reason   string `json:"reason"`
+	Status   string `json:"status"`
+}
+
+// Invoice is a decoded invoice object. Invoices call the time that they were
+// created `date`.
+type Invoice struct {
+	AmountDue    int64            `json:"amount_due"`
+	Currency     string           `json:"currency"`
+	Customer     string           `json:"customer"`
+	Date         int64            `json:"date"`
+	ID           string           `json:"id"`
+	Lines        *InvoiceLineList `json:"lines"`
+	Paid         bool             `json:"paid"`
+	Subscription string           `json:"subscription"`
+	Total        int64            `json:"total"`
+}
+
+// InvoiceLine is a decoded line item embedded in an invoice.
+type InvoiceLine struct {
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency"`
+	Description string `json:"description"`
+	ID          string `json:"id"`
+	Period      struct {
+		End   int64 `json:"end"`
+		Start int64 `json:"start"`
+	} `json:"period"`
+	Plan         *Plan  `json:"plan"`
+	Proration    bool   `json:"proration"`
+	Quantity     *int64 `json:"quantity"`
+	Subscription string `json:"subscription"`
+	Type         string `json:"type"`
+}
+
+// InvoiceLineList is the list of line items embedded in an invoice. Like
+// every embedded list, it may only hold the first page of items, in which
+// case HasMore is set.
+type InvoiceLineList struct {
+	Data    []*InvoiceLine `json:"data"`
+	HasMore bool           `json:"has_more"`
+}
+
+// Plan is a decoded plan object. It's only modeled as it's embedded in a
+// subscription.
+type Plan struct {
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	ID            string `json:"id"`
+	Interval      string `json:"interval"`
+	IntervalCount int64  `json:"interval_count"`
+}
+
+// Refund is a decoded refund embedded in a charge.
+type Refund struct {
+	Amount   int64  `json:"amount"`
+	Created  int64  `json:"created"`
+	Currency string `json:"currency"`
+	ID       string `json:"id"`
+	Reason   string `json:"reason"`
+}
+
+// RefundList is the list of refunds embedded in a charge.
+type RefundList struct {
+	Data    []*Refund `json:"data"`
+	HasMore bool      `json:"has_more"`
+}
+
+// Subscription is a decoded subscription object.
+type Subscription struct {
+	CanceledAt *int64                `json:"canceled_at"`
+	Created    int64                 `json:"created"`
+	Customer   string                `json:"customer"`
+	ID         string                `json:"id"`
+	Items      *SubscriptionItemList `json:"items"`
+	Plan       *Plan                 `json:"plan"`
+	Quantity   int64                 `json:"quantity"`
+	Status     string                `json:"status"`
+}
+
+// SubscriptionItem is a decoded item embedded in a subscription.
+type SubscriptionItem struct {
+	Created  int64  `json:"created"`
+	ID       string `json:"id"`
+	Plan     *Plan  `json:"plan"`
+	Quantity int64  `json:"quantity"`
+}
+
+// SubscriptionItemList is the list of items embedded in a subscription.
+type SubscriptionItemList struct {
+	Data    []*SubscriptionItem `json:"data"`
+	HasMore bool                `json:"has_more"`
+}
+
+// The schema of a plan wherever it's embedded.
+var planSchema = []Field{
+	{Name: "amount", Type: IntegerField, Required: true},
+	{Name: "currency", Type: StringField, Required: true},
+	{Name: "id", Type: StringField, Required: true},
+	{Name: "interval", Type: StringField, Required: true},
+	{Name: "interval_count", Type: IntegerField, Required: true},
+}
+
+var objectTypes = map[string]*ObjectType{
+	"charge": {
+		Schema: []Field{
+			{Name: "amount", Type: IntegerField, Required: true},
+			{Name: "created", Type: TimestampField, Required: true},
+			{Name: "currency", Type: StringField, Required: true},
+			{Name: "customer", Type: StringField},
+			{Name: "id", Type: StringField, Required: true},
+			{Name: "refunds", Type: ListField, Fields: []Field{
+				{Name: "amount", Type: IntegerField, Required: true},
+				{Name: "created", Type: TimestampField, Required: true},
+				{Name: "currency", Type: StringField, Required: true},
+				{Name: "id", Type: StringField, Required: true},
+				{Name: "reason", Type: StringField},
+			}},
+			{Name: "status", Type: StringField},
+		},
+		New: func() interface{} { return &Charge{} },
+	},
+	"customer": {
+		Schema: []Field{
+			{Name: "created", Type: TimestampField, Required: true},
+			{Name: "delinquent", Type: BooleanField},
+			{Name: "description", Type: StringField},
+			{Name: "email", Type: StringField},
+			{Name: "id", Type: StringField, Required: true},
+		},
+		New: func() interface{} { return &Customer{} },
+	},
+	"dispute": {
+		Schema: []Field{
+			{Name: "amount", Type: IntegerField, Required: true},
+			{Name: "charge", Type: StringField, Required: true},
+			{Name: "created", Type: TimestampField, Required: true},
+			{Name: "currency", Type: StringField, Required: true},
+			{Name: "id", Type: StringField, Required: true},
+			{Name: "reason", Type: StringField},
+			{Name: "status", Type: StringField, Required: true},
+		},
+		New: func() interface{} { return &Dispute{} },
+	},
+	"invoice": {
+		Schema: []Field{
+			{Name: "amount_due", Type: IntegerField, Required: true},
+			{Name: "currency", Type: StringField, Required: true},
+			{Name: "customer", Type: StringField, Required: true},
+			{Name: "date", Type: TimestampField, Required: true},
+			{Name: "id", Type: StringField, Required: true},
+			{Name: "lines", Type: ListField, Fields: []Field{
+				{Name: "amount", Type: IntegerField, Required: true},
+				{Name: "currency", Type: StringField, Required: true},
+				{Name: "description", Type: StringField},
+				{Name: "id", Type: StringField, Required: true},
+				{Name: "period", Type: ObjectField, Required: true, Fields: []Field{
+					{Name: "end", Type: TimestampField, Required: true},
+					{Name: "start", Type: TimestampField, Required: true},
+				}},
+				{Name: "plan", Type: ObjectField, Fields: planSchema},
+				{Name: "proration", Type: BooleanField},
+				{Name: "quantity", Type: IntegerField},
+				{Name: "subscription", Type: StringField},
+				{Name: "type", Type: StringField, Required: true},
+			}},
+			{Name: "paid", Type: BooleanField},
+			{Name: "subscription", Type: StringField},
+			{Name: "total", Type: IntegerField, Required: true},
+		},
+		New: func() interface{} { return &Invoice{} },
+	},
+	"subscription": {
+		Schema: []Field{
+			{Name: "canceled_at", Type: TimestampField},
+			{Name: "created", Type: TimestampField, Required: true},
+			{Name: "customer", Type: StringField, Required: true},
+			{Name: "id", Type: StringField, Required: true},
+			{Name: "items", Type: ListField, Fields: []Field{
+				{Name: "created", Type: TimestampField, Required: true},
+				{Name: "id", Type: StringField, Required: true},
+				{Name: "plan", Type: ObjectField, Required: true, Fields: planSchema},
+				{Name: "quantity", Type: IntegerField, Required: true},
+			}},
+			{Name: "plan", Type: ObjectField, Required: true, Fields: planSchema},
+			{Name: "quantity", Type: IntegerField, Required: true},
+			{Name: "status", Type: StringField, Required: true},
+		},
+		New: func() interface{} { return &Subscription{} },
+	},
+}
+
+// FieldError describes a single field of an object that didn't conform to
+// its schema.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) String() string {
+	return fmt.Sprintf("%v: %v", e.Field, e.Message)
+}
+
+// DecodeError is returned when an event's object couldn't be decoded. It
+// identifies the offending event so that it can be found in the feed.
+type DecodeError struct {
+	Sequence uint64
+	Type     string
+
+	// Fields contains any fields that failed validation. It's empty if the
+	// object wasn't valid JSON at all, in which case Err is set instead.
+	Fields []FieldError
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	var problems []string
+	for _, field := range e.Fields {
+		problems = append(problems, field.String())
+	}
+	if e.Err != nil {
+		problems = append(problems, e.Err.Error())
+	}
+
+	return fmt.Sprintf("Couldn't decode event at sequence %v (%v): %v",
+		e.Sequence, e.Type, strings.Join(problems, "; "))
+}
+
+// Decodes an event's data object into its typed struct, setting Object and
+// ObjectType on the event. Events with no object or carrying an object type
+// that we don't model are left alone. Events in a newer envelope than we
+// understand fail so that they're dead lettered until the consumer is
+// upgraded, rather than being misread.
+func decodeEvent(event *Event) error {
+	err := envelope.CheckVersion(event.EnvelopeVersion)
+	if err != nil {
+		return &DecodeError{Sequence: event.Sequence, Type: event.Type, Err: err}
+	}
+
+	if len(event.Data.Object) == 0 {
+		return nil
+	}
+
+	// Numbers are decoded as json.Number so that they can be checked for
+	// being integers without first being rounded through a float64.
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(event.Data.Object))
+	decoder.UseNumber()
+	err = decoder.Decode(&fields)
+	if err != nil {
+		return &DecodeError{Sequence: event.Sequence, Type: event.Type, Err: err}
+	}
+
+	name := objectTypeName(event, fields)
+	objectType, ok := objectTypes[name]
+	if !ok {
+		return nil
+	}
+
+	fieldErrors := validateObject("", objectType.Schema, fields)
+	if len(fieldErrors) > 0 {
+		return &DecodeError{Sequence: event.Sequence, Type: event.Type, Fields: fieldErrors}
+	}
+
+	object := objectType.New()
+	err = json.Unmarshal(event.Data.Object, object)
+	if err != nil {
+		return &DecodeError{Sequence: event.Sequence, Type: event.Type, Err: err}
+	}
+
+	event.Object = object
+	event.ObjectType = name
+	return nil
+}
+
+// Determines the type of an event's object. Objects usually tell us
+// themselves, but if they don't it can be inferred from the event's type,
+// which is named after the object (e.g. "charge.created" or
+// "customer.subscription.updated").
+func objectTypeName(event *Event, fields map[string]interface{}) string {
+	if name, ok := fields["object"].(string); ok {
+		return name
+	}
+
+	parts := strings.Split(event.Type, ".")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
+
+// Returns the type of an event's object. Unlike decodeEvent, this works even
+// if the object is malformed, in which case the type is inferred from the
+// event's type.
+func eventObjectType(event *Event) string {
+	var fields map[string]interface{}
+	json.Unmarshal(event.Data.Object, &fields)
+	return objectTypeName(event, fields)
+}
+
+// Checks an object's fields against a schema, returning every field that
+// doesn't conform. Fields of nested objects are reported with their full path
+// like "plan.amount", and those of list items with their index like
+// "refunds.data[0].amount".
+func validateObject(prefix string, schema []Field, fields map[string]interface{}) []FieldError {
+	var errors []FieldError
+	for _, field := range schema {
+		path := prefix + field.Name
+
+		value, ok := fields[field.Name]
+		if !ok || value == nil {
+			if field.Required {
+				errors = append(errors, FieldError{path, "required field is missing"})
+			}
+			continue
+		}
+
+		if message := validateValue(field.Type, value); message != "" {
+			errors = append(errors, FieldError{path, message})
+			continue
+		}
+
+		switch field.Type {
+		case ListField:
+			items := value.(map[string]interface{})["data"].([]interface{})
+			for i, item := range items {
+				itemPath := fmt.Sprintf("%v.data[%v]", path, i)
+				object, ok := item.(map[string]interface{})
+				if !ok {
+					errors = append(errors, FieldError{itemPath,
+						fmt.Sprintf("expected object but got %v", jsonTypeName(item))})
+					continue
+				}
+				errors = append(errors, validateObject(itemPath+".", field.Fields, object)...)
+			}
+
+		case ObjectField:
+			errors = append(errors, validateObject(path+".", field.Fields,
+				value.(map[string]interface{}))...)
+		}
+	}
+	return errors
+}
+
+func validateValue(fieldType FieldType, value interface{}) string {
+	switch fieldType {
+	case BooleanField:
+		if _, ok := value.(bool); ok {
+			return ""
+		}
+
+	case ListField:
+		if object, ok := value.(map[string]interface{}); ok {
+			if _, ok := object["data"].([]interface{}); !ok {
+				return "expected list but got object without a data array"
+			}
+			return ""
+		}
+
+	case ObjectField:
+		if _, ok := value.(map[string]interface{}); ok {
+			return ""
+		}
+
+	case IntegerField, TimestampField:
+		if number, ok := value.(json.Number); ok {
+			_, err := strconv.ParseInt(string(number), 10, 64)
+			if err != nil {
+				return fmt.Sprintf("expected %v but got %v", fieldType, number)
+			}
+			return ""
+		}
+
+	case StringField:
+		if _, ok := value.(string); ok {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf("expected %v but got %v", fieldType, jsonTypeName(value))
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "null"
+}
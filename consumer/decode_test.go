@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/brandur/stripe-warehouse/envelope"
+)
+
+func TestDecodeEvent(t *testing.T) {
+	testCases := []struct {
+		name            string
+		eventType       string
+		envelopeVersion int
+		object          string
+
+		// Either the decoded object and its type, or the problems listed in
+		// the error.
+		want       interface{}
+		wantType   string
+		wantErrors []string
+	}{
+		{
+			name:      "Charge",
+			eventType: "charge.succeeded",
+			object: `{"object":"charge","id":"ch_123","amount":1000,"created":1500000000,
+				"currency":"usd","customer":"cus_123","status":"succeeded"}`,
+			want: &Charge{Amount: 1000, Created: 1500000000, Currency: "usd",
+				Customer: "cus_123", ID: "ch_123", Status: "succeeded"},
+			wantType: "charge",
+		},
+		{
+			name:      "ChargeWithRefunds",
+			eventType: "charge.refunded",
+			object: `{"object":"charge","id":"ch_123","amount":1000,"created":1500000000,
+				"currency":"usd","refunds":{"data":[{"id":"re_123","amount":500,
+				"created":1500000001,"currency":"usd"}]}}`,
+			want: &Charge{Amount: 1000, Created: 1500000000, Currency: "usd", ID: "ch_123",
+				Refunds: &RefundList{Data: []*Refund{
+					{Amount: 500, Created: 1500000001, Currency: "usd", ID: "re_123"},
+				}}},
+			wantType: "charge",
+		},
+		{
+			name:      "TypeInferredFromEvent",
+			eventType: "customer.created",
+			object:    `{"id":"cus_123","created":1500000000,"email":"a@example.com"}`,
+			want:      &Customer{Created: 1500000000, Email: "a@example.com", ID: "cus_123"},
+			wantType:  "customer",
+		},
+		{
+			name:      "TypeInferredFromNestedEvent",
+			eventType: "customer.subscription.deleted",
+			object: `{"id":"sub_123","created":1500000000,"customer":"cus_123",
+				"plan":{"id":"gold","amount":2000,"currency":"usd","interval":"month",
+				"interval_count":1},"quantity":1,"status":"canceled"}`,
+			want: &Subscription{Created: 1500000000, Customer: "cus_123", ID: "sub_123",
+				Plan: &Plan{Amount: 2000, Currency: "usd", ID: "gold", Interval: "month",
+					IntervalCount: 1},
+				Quantity: 1, Status: "canceled"},
+			wantType: "subscription",
+		},
+		{
+			name:      "UnknownObjectType",
+			eventType: "payout.paid",
+			object:    `{"object":"payout","id":"po_123"}`,
+		},
+		{
+			name:      "NoObject",
+			eventType: "ping",
+		},
+		{
+			name:       "MalformedJSON",
+			eventType:  "charge.succeeded",
+			object:     `{"object":"charge",`,
+			wantErrors: []string{"unexpected EOF"},
+		},
+		{
+			name:       "MissingRequiredField",
+			eventType:  "charge.succeeded",
+			object:     `{"object":"charge","id":"ch_123","created":1500000000,"currency":"usd"}`,
+			wantErrors: []string{"amount: required field is missing"},
+		},
+		{
+			name:      "EveryInvalidFieldReported",
+			eventType: "charge.succeeded",
+			object: `{"object":"charge","id":"ch_123","amount":"1000","created":1.5,
+				"currency":"usd","status":null}`,
+			wantErrors: []string{
+				"amount: expected integer but got string",
+				"created: expected timestamp but got 1.5",
+			},
+		},
+		{
+			name:            "LegacyEnvelope",
+			eventType:       "customer.created",
+			envelopeVersion: 0,
+			object:          `{"object":"customer","id":"cus_123","created":1500000000}`,
+			want:            &Customer{Created: 1500000000, ID: "cus_123"},
+			wantType:        "customer",
+		},
+		{
+			name:            "CurrentEnvelope",
+			eventType:       "customer.created",
+			envelopeVersion: envelope.Version,
+			object:          `{"object":"customer","id":"cus_123","created":1500000000}`,
+			want:            &Customer{Created: 1500000000, ID: "cus_123"},
+			wantType:        "customer",
+		},
+		{
+			name:            "NewerEnvelope",
+			eventType:       "customer.created",
+			envelopeVersion: envelope.Version + 1,
+			object:          `{"object":"customer","id":"cus_123","created":1500000000}`,
+			wantErrors:      []string{"Unsupported envelope version"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			event := &Event{
+				EnvelopeVersion: testCase.envelopeVersion,
+				Sequence:        42,
+				Type:            testCase.eventType,
+			}
+			if testCase.object != "" {
+				event.Data.Object = json.RawMessage(testCase.object)
+			}
+
+			err := decodeEvent(event)
+
+			if testCase.wantErrors != nil {
+				decodeErr, ok := err.(*DecodeError)
+				if !ok {
+					t.Fatalf("Expected a DecodeError, got %v", err)
+				}
+				if decodeErr.Sequence != 42 || decodeErr.Type != testCase.eventType {
+					t.Errorf("Error doesn't identify the event: %v", decodeErr)
+				}
+				for _, want := range testCase.wantErrors {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("Expected error to contain %q: %v", want, err)
+					}
+				}
+				if event.Object != nil {
+					t.Errorf("Expected no object, got %+v", event.Object)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.ObjectType != testCase.wantType {
+				t.Errorf("Expected object type %q, got %q", testCase.wantType, event.ObjectType)
+			}
+			if testCase.want == nil {
+				if event.Object != nil {
+					t.Errorf("Expected no object, got %+v", event.Object)
+				}
+				return
+			}
+			if !reflect.DeepEqual(event.Object, testCase.want) {
+				t.Errorf("Expected %+v, got %+v", testCase.want, event.Object)
+			}
+		})
+	}
+}
+
+func TestValidateObject(t *testing.T) {
+	schema := []Field{
+		{Name: "id", Type: StringField, Required: true},
+		{Name: "count", Type: IntegerField},
+		{Name: "created", Type: TimestampField},
+		{Name: "live", Type: BooleanField},
+		{Name: "period", Type: ObjectField, Fields: []Field{
+			{Name: "start", Type: TimestampField, Required: true},
+		}},
+		{Name: "items", Type: ListField, Fields: []Field{
+			{Name: "id", Type: StringField, Required: true},
+			{Name: "plan", Type: ObjectField, Required: true, Fields: []Field{
+				{Name: "amount", Type: IntegerField, Required: true},
+			}},
+		}},
+	}
+
+	testCases := []struct {
+		name   string
+		object string
+		want   []FieldError
+	}{
+		{
+			name: "Valid",
+			object: `{"id":"obj_123","count":3,"created":1500000000,"live":true,
+				"period":{"start":1500000000},
+				"items":{"data":[{"id":"item_1","plan":{"amount":100}}]}}`,
+		},
+		{
+			name:   "OptionalFieldsMissingOrNull",
+			object: `{"id":"obj_123","count":null,"period":null}`,
+		},
+		{
+			name:   "UnknownFieldsIgnored",
+			object: `{"id":"obj_123","extra":{"anything":[1,2,3]}}`,
+		},
+		{
+			name:   "RequiredFieldMissing",
+			object: `{"count":3}`,
+			want:   []FieldError{{"id", "required field is missing"}},
+		},
+		{
+			name:   "RequiredFieldNull",
+			object: `{"id":null}`,
+			want:   []FieldError{{"id", "required field is missing"}},
+		},
+		{
+			name:   "WrongTypes",
+			object: `{"id":123,"count":"3","live":"yes","period":[]}`,
+			want: []FieldError{
+				{"id", "expected string but got number"},
+				{"count", "expected integer but got string"},
+				{"live", "expected boolean but got string"},
+				{"period", "expected object but got array"},
+			},
+		},
+		{
+			name:   "IntegerNotWhole",
+			object: `{"id":"obj_123","count":1.5,"created":1e3}`,
+			want: []FieldError{
+				{"count", "expected integer but got 1.5"},
+				{"created", "expected timestamp but got 1e3"},
+			},
+		},
+		{
+			name:   "IntegerOverflow",
+			object: `{"id":"obj_123","count":99999999999999999999}`,
+			want:   []FieldError{{"count", "expected integer but got 99999999999999999999"}},
+		},
+		{
+			name:   "NestedObjectField",
+			object: `{"id":"obj_123","period":{"start":"soon"}}`,
+			want:   []FieldError{{"period.start", "expected timestamp but got string"}},
+		},
+		{
+			name:   "ListWithoutData",
+			object: `{"id":"obj_123","items":{"object":"list"}}`,
+			want:   []FieldError{{"items", "expected list but got object without a data array"}},
+		},
+		{
+			name:   "ListItemNotObject",
+			object: `{"id":"obj_123","items":{"data":["item_1"]}}`,
+			want:   []FieldError{{"items.data[0]", "expected object but got string"}},
+		},
+		{
+			name: "ListItemFields",
+			object: `{"id":"obj_123","items":{"data":[
+				{"id":"item_1","plan":{"amount":100}},
+				{"plan":{"amount":"100"}}]}}`,
+			want: []FieldError{
+				{"items.data[1].id", "required field is missing"},
+				{"items.data[1].plan.amount", "expected integer but got string"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var fields map[string]interface{}
+			decoder := json.NewDecoder(bytes.NewReader([]byte(testCase.object)))
+			decoder.UseNumber()
+			err := decoder.Decode(&fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := validateObject("", schema, fields)
+			if !reflect.DeepEqual(got, testCase.want) {
+				t.Errorf("Expected %v, got %v", testCase.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/brandur/stripe-warehouse/envelope"
+	"github.com/lib/pq"
+)
+
+// Tables with a customer column whose objects depend on a customer. Their
+// rows and events are kept so that financial figures don't change, but
+// unlinked from the customer.
+var erasureTables = []string{"charges", "invoices", "subscriptions"}
+
+// Fields of dependent objects that hold a customer's personal details
+// alongside the reference to it, which are removed from their archived
+// events.
+var erasurePersonalFields = []string{
+	"billing_details",
+	"customer_address",
+	"customer_email",
+	"customer_name",
+	"customer_phone",
+	"customer_shipping",
+	"customer_tax_ids",
+	"receipt_email",
+	"shipping",
+}
+
+// erasureObject is an object that's erased along with a customer.
+type erasureObject struct {
+	Table string
+	ID    string
+}
+
+// Erases a customer from both the Kafka topic and the warehouse:
+//
+//   - A tombstone is produced for the customer and each object that depends
+//     on it (its charges, invoices, and subscriptions) so that compaction
+//     removes their messages from the topic.
+//   - The customer's rows are deleted, and dependent rows are anonymized by
+//     clearing their customer.
+//   - The customer's archived events and dead letters are deleted because
+//     there's no telling what they contain. Those of other objects that
+//     reference the customer are kept, but have the reference cleared, and
+//     those of dependents have their personal fields removed too.
+//   - The customer and its dependents are recorded in `deletions` so that
+//     replaying their messages from before compaction can't bring them back.
+//     As with a reload from the compacted topic, a rebuild leaves the
+//     dependents out.
+//   - An entry is written to the `erasures` audit table.
+//
+// Tombstones are produced before the warehouse's transaction commits so that
+// if either fails, the erasure can be run again and will find the same
+// objects.
+func erase(db *sql.DB, conf Conf, args []string) error {
+	flags := flag.NewFlagSet("erase", flag.ExitOnError)
+	account := flags.String("account", "", "Connected account that the customer belongs to")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: consumer erase [-account <account>] <customer>")
+	}
+	customer := flags.Arg(0)
+
+	if conf.KafkaTopic == "" {
+		return fmt.Errorf("KAFKA_TOPIC is required to erase from the topic")
+	}
+
+	start := time.Now()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	objects, err := erasureObjects(tx, *account, customer)
+	if err != nil {
+		return err
+	}
+
+	var ids, dependentIDs []string
+	for _, object := range objects {
+		ids = append(ids, object.ID)
+		if object.Table != "customers" {
+			dependentIDs = append(dependentIDs, object.ID)
+		}
+	}
+
+	err = produceTombstones(conf, *account, ids)
+	if err != nil {
+		return err
+	}
+
+	var rowsDeleted, rowsAnonymized, eventsDeleted, referencesRedacted int64
+
+	for _, name := range []string{"customers", "customers_history"} {
+		n, err := execCount(tx, fmt.Sprintf(`DELETE FROM %s WHERE account_id = $1 AND id = $2`,
+			name), *account, customer)
+		if err != nil {
+			return err
+		}
+		rowsDeleted += n
+	}
+
+	for _, name := range erasureTables {
+		for _, name := range []string{name, name + "_history"} {
+			n, err := execCount(tx, fmt.Sprintf(`
+				UPDATE %s SET customer = NULL
+				WHERE account_id = $1 AND customer = $2`,
+				name), *account, customer)
+			if err != nil {
+				return err
+			}
+			rowsAnonymized += n
+		}
+	}
+
+	// Platform events don't carry an account at all.
+	for _, name := range []string{"events", "dead_letter_events"} {
+		n, err := execCount(tx, fmt.Sprintf(`
+			DELETE FROM %s
+			WHERE coalesce(data->>'account', '') = $1
+				AND data->'data'->'object'->>'id' = $2`,
+			name), *account, customer)
+		if err != nil {
+			return err
+		}
+		eventsDeleted += n
+
+		n, err = redactCustomerEvents(tx, name, *account, customer)
+		if err != nil {
+			return err
+		}
+		referencesRedacted += n
+
+		n, err = redactDependentEvents(tx, name, *account, dependentIDs)
+		if err != nil {
+			return err
+		}
+		referencesRedacted += n
+	}
+
+	err = recordErasureDeletions(tx, *account, objects)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO erasures (account_id, customer, object_ids, tombstones,
+			rows_deleted, rows_anonymized, events_deleted,
+			references_redacted, erased_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, now())`,
+		*account, customer, pq.Array(ids), len(ids),
+		rowsDeleted, rowsAnonymized, eventsDeleted, referencesRedacted)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Erased %v in %v: %v tombstone(s) produced, %v row(s) deleted, "+
+		"%v row(s) anonymized, %v event(s) deleted, %v redaction(s) in events.",
+		customer, time.Now().Sub(start), len(ids),
+		rowsDeleted, rowsAnonymized, eventsDeleted, referencesRedacted)
+	return nil
+}
+
+// Clears references to a customer from the archived events of other objects
+// in an events table, both in the object and in its previous attributes (in
+// case the object has since moved to another customer). Returns the number
+// of references cleared.
+func redactCustomerEvents(tx *sql.Tx, name, account, customer string) (int64, error) {
+	var redacted int64
+	for _, path := range []string{"{data,object,customer}", "{data,previous_attributes,customer}"} {
+		n, err := execCount(tx, fmt.Sprintf(`
+			UPDATE %s
+			SET data = jsonb_set(data, '%s', 'null')
+			WHERE coalesce(data->>'account', '') = $1
+				AND data #>> '%s' = $2`,
+			name, path, path), account, customer)
+		if err != nil {
+			return 0, err
+		}
+		redacted += n
+	}
+	return redacted, nil
+}
+
+// Removes the personal fields of dependent objects from their archived
+// events in an events table, both from the object and from its previous
+// attributes. Returns the number of events changed.
+func redactDependentEvents(tx *sql.Tx, name, account string, ids []string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	var removals []string
+	for _, key := range []string{"object", "previous_attributes"} {
+		for _, field := range erasurePersonalFields {
+			removals = append(removals, fmt.Sprintf("#- '{data,%s,%s}'", key, field))
+		}
+	}
+
+	return execCount(tx, fmt.Sprintf(`
+		UPDATE %s
+		SET data = data %s
+		WHERE coalesce(data->>'account', '') = $1
+			AND data->'data'->'object'->>'id' = ANY($2)
+			AND (data->'data'->'object' ?| $3
+				OR data->'data'->'previous_attributes' ?| $3)`,
+		name, strings.Join(removals, " ")),
+		account, pq.Array(ids), pq.Array(erasurePersonalFields))
+}
+
+// Records erased objects in `deletions` as deleted now at the current
+// checkpoint, so that writes of them from any event created before the
+// erasure are rejected as stale.
+func recordErasureDeletions(tx *sql.Tx, account string, objects []erasureObject) error {
+	for _, object := range objects {
+		_, err := tx.Exec(`
+			INSERT INTO deletions (table_name, account_id, id, event_created, sequence)
+			VALUES ($1, $2, $3, now(),
+				coalesce((SELECT sequence FROM checkpoints WHERE name = 'feed'), 0))
+			ON CONFLICT (table_name, account_id, id) DO UPDATE SET
+				event_created = excluded.event_created,
+				sequence = excluded.sequence`,
+			object.Table, account, object.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns a customer and every object that depends on it, starting with the
+// customer. History is included so that objects that have since been moved
+// to another customer are found as well.
+func erasureObjects(tx *sql.Tx, account, customer string) ([]erasureObject, error) {
+	objects := []erasureObject{{"customers", customer}}
+
+	for _, name := range erasureTables {
+		tableIDs, err := queryIDs(tx, fmt.Sprintf(`
+			SELECT id FROM %s WHERE account_id = $1 AND customer = $2
+			UNION
+			SELECT id FROM %s_history WHERE account_id = $1 AND customer = $2`,
+			name, name), account, customer)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range tableIDs {
+			objects = append(objects, erasureObject{name, id})
+		}
+	}
+	return objects, nil
+}
+
+// Produces a tombstone (a message with a null value) for each object so
+// that compaction removes every message keyed by its ID. They're tagged with
+// the account in the same way as the feeder's messages.
+func produceTombstones(conf Conf, account string, ids []string) error {
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_11_0_0
+	config.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(strings.Split(conf.SeedBroker, ","), config)
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	messages := make([]*sarama.ProducerMessage, len(ids))
+	for i, id := range ids {
+		messages[i] = &sarama.ProducerMessage{
+			Topic: conf.KafkaTopic,
+			Key:   sarama.StringEncoder(id),
+		}
+		if account != "" {
+			messages[i].Headers = []sarama.RecordHeader{
+				{Key: []byte(envelope.AccountHeader), Value: []byte(account)},
+			}
+		}
+	}
+
+	return producer.SendMessages(messages)
+}
+
+// Runs a statement and returns the number of rows that it affected.
+func execCount(tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func queryIDs(tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
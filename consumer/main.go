@@ -1,36 +1,178 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/brandur/stripe-warehouse/redact"
 	"github.com/joeshaw/envdecode"
 	"github.com/lib/pq"
-	"github.com/stripe/stripe-go"
 )
 
 const (
 	PageBuffer         = 10
+	RebuildPageSize    = 10000
+	RebuildSuffix      = "_rebuild"
 	ReportingIncrement = 100
+
+	// Number of events that must have been loaded before the dead letter
+	// rate is checked so that a single bad event early in a run doesn't
+	// halt it.
+	DeadLetterRateMinEvents = 1000
 )
 
 type Conf struct {
-	DatabaseURL string `env:"DATABASE_URL,required"`
-	StripeKey   string `env:"STRIPE_KEY,required"`
-	StripeURL   string `env:"STRIPE_URL,default=https://api.stripe.com"`
+	// Whether to maintain the daily aggregate tables (like `daily_volume`)
+	// as each page is loaded. Only supported when loading into Postgres, and
+	// requires HISTORY.
+	Aggregates bool `env:"AGGREGATES,default=false"`
+
+	// Required when loading into Postgres and for every other command.
+	DatabaseURL string `env:"DATABASE_URL"`
+
+	// Fraction of events that may be dead lettered before the run is halted
+	// on the assumption that something is systematically wrong.
+	DeadLetterMaxRate float64 `env:"DEAD_LETTER_MAX_RATE,default=0.01"`
+
+	// Number of goroutines decoding and mapping pages of events while
+	// others are being fetched and loaded.
+	DecodeWorkers int `env:"DECODE_WORKERS,default=4"`
+
+	// CSV file of exchange rates used to convert amounts to USD. If it's not
+	// set, USD amounts are left NULL.
+	FXRatesPath string `env:"FX_RATES_PATH"`
+
+	// Whether to keep every version of each object in a `<table>_history`
+	// table alongside the current state. Supported by the Postgres and SQLite
+	// sinks.
+	History bool `env:"HISTORY,default=false"`
+
+	// Directory of numbered SQL migrations that are applied to Postgres at
+	// startup.
+	MigrationsDir string `env:"MIGRATIONS_DIR,default=db/migrations"`
+
+	// Used only when reading directly from Kafka.
+	KafkaTopic string `env:"KAFKA_TOPIC"`
+	SeedBroker string `env:"SEED_BROKER,default=localhost:9092"`
+
+	// Number of times a failed request for a page is retried before giving
+	// up, and how long any single attempt may take.
+	RequestMaxRetries int           `env:"REQUEST_MAX_RETRIES,default=8"`
+	RequestTimeout    time.Duration `env:"REQUEST_TIMEOUT,default=60s"`
+
+	// Used only when loading into Parquet files. Files are rolled once
+	// they reach roughly PARQUET_FILE_SIZE bytes.
+	ParquetDir      string `env:"PARQUET_DIR,default=parquet"`
+	ParquetFileSize int64  `env:"PARQUET_FILE_SIZE,default=134217728"`
+
+	// Used only when archiving to S3 or an S3-compatible store like MinIO.
+	// Objects are uploaded once they reach roughly S3_OBJECT_SIZE
+	// compressed bytes, in multiple parts if they're larger than
+	// S3_PART_SIZE.
+	S3AccessKeyID     string `env:"S3_ACCESS_KEY_ID"`
+	S3Bucket          string `env:"S3_BUCKET"`
+	S3Endpoint        string `env:"S3_ENDPOINT,default=s3.amazonaws.com"`
+	S3ObjectSize      int    `env:"S3_OBJECT_SIZE,default=67108864"`
+	S3PartSize        int    `env:"S3_PART_SIZE,default=16777216"`
+	S3Prefix          string `env:"S3_PREFIX,default=events"`
+	S3SecretAccessKey string `env:"S3_SECRET_ACCESS_KEY"`
+	S3Secure          bool   `env:"S3_SECURE,default=true"`
+
+	// Policy for redacting personal information from event objects before
+	// they're loaded, as a comma-separated list of path=action rules (see
+	// the README). REDACT_KEY is the secret that hashed values are keyed
+	// with, and is required by any rule that hashes.
+	RedactKey    string `env:"REDACT_KEY"`
+	RedactPolicy string `env:"REDACT_POLICY"`
+
+	// Base URL of the Stripe API that tables are reconciled against. Unlike
+	// STRIPE_URL, this is always the real API rather than the endpoint.
+	ReconcileURL string `env:"RECONCILE_URL,default=https://api.stripe.com"`
+
+	// Where events are loaded to: "postgres", "sqlite" to write to a local
+	// database file at SQLITE_PATH, which is handy for local analysis and
+	// tests, "parquet" to write files under PARQUET_DIR, or "s3" to archive
+	// the raw feed to a bucket.
+	Sink       string `env:"SINK,default=postgres"`
+	SQLitePath string `env:"SQLITE_PATH,default=warehouse.db"`
+
+	// Where events are read from: "http" to page through the endpoint, or
+	// "kafka" to read the topic directly, which avoids the overhead of the
+	// endpoint when running inside the same network as Kafka.
+	Source string `env:"SOURCE,default=http"`
+
+	StripeKey string `env:"STRIPE_KEY"`
+	StripeURL string `env:"STRIPE_URL,default=https://api.stripe.com"`
 }
 
 // Use a custom event implementation because the one included with the stripe
 // package doesn't have our special "offset" field.
 type Event struct {
-	Data     stripe.EventData `json:"data"`
-	Sequence uint64           `json:"sequence"`
-	Type     string           `json:"type"`
+	// Account is the connected account that the event belongs to, or empty
+	// for the platform's own events.
+	Account string `json:"account"`
+
+	Created int64     `json:"created"`
+	Data    EventData `json:"data"`
+
+	// Deleted is set on events made from a deletion's tombstone, whose
+	// object carries only its ID and type.
+	Deleted bool `json:"deleted"`
+
+	// EnvelopeVersion is the version of the envelope format that the event
+	// was produced in, or 0 if it was produced before envelopes were
+	// versioned.
+	EnvelopeVersion int `json:"envelope_version"`
+
+	ID       string `json:"id"`
+	Sequence uint64 `json:"sequence"`
+	Type     string `json:"type"`
+
+	// Object is the event's data object decoded to its typed struct (like
+	// *Charge) by decodeEvent. It's nil until then, or if the object isn't
+	// one that we model.
+	Object interface{} `json:"-"`
+
+	// ObjectType is the type of Object, like "charge".
+	ObjectType string `json:"-"`
+
+	// Raw is the event exactly as it was received from the server. It's
+	// archived as is so that fields we haven't modeled yet are still
+	// available.
+	Raw json.RawMessage `json:"-"`
+}
+
+// EventData holds an event's object undecoded. Unlike the stripe package's
+// version, it doesn't eagerly decode into a map of float64s which would
+// lose precision on large integers.
+type EventData struct {
+	Object             json.RawMessage `json:"object"`
+	PreviousAttributes json.RawMessage `json:"previous_attributes,omitempty"`
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	// Decode through an alias type so that we don't recurse back into this
+	// function.
+	type event Event
+	var ev event
+	err := json.Unmarshal(data, &ev)
+	if err != nil {
+		return err
+	}
+
+	*e = Event(ev)
+
+	// The decoder may reuse its buffer, so take a copy.
+	e.Raw = append(json.RawMessage(nil), data...)
+	return nil
 }
 
 type Page struct {
@@ -47,130 +189,268 @@ func main() {
 		log.Fatal(err)
 	}
 
-	db, err := sql.Open("postgres", conf.DatabaseURL)
-	if err != nil {
-		log.Fatal(err)
+	// Rates are needed anywhere that events are mapped, which includes most
+	// commands.
+	if conf.FXRatesPath != "" {
+		fxRates, err = loadFXRates(conf.FXRatesPath)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	doneChan := make(chan int)
-	pageChan := make(chan Page, PageBuffer)
-	start := time.Now()
-
-	// Request events from the API.
-	go func() {
-		err := requestEvents(conf.StripeKey, conf.StripeURL, doneChan, pageChan)
+	// Like rates, the redaction policy applies anywhere that events are
+	// mapped.
+	if conf.RedactPolicy != "" {
+		redactPolicy, err = redact.Parse(conf.RedactPolicy, []byte(conf.RedactKey))
 		if err != nil {
 			log.Fatal(err)
 		}
-	}()
-
-	// And simultaneously, load them to Postgres.
-	numProcessed, err := loadEvents(doneChan, pageChan, db)
-	if err != nil {
-		log.Fatal(err)
 	}
 
-	log.Printf("Reached end of the log. Processed %v event(s) in %v.",
-		numProcessed, time.Now().Sub(start))
-}
+	// With no arguments we load from the feed, but a few other commands are
+	// available that work only with what's already in the warehouse.
+	if len(os.Args) > 1 {
+		if conf.DatabaseURL == "" {
+			log.Fatal("DATABASE_URL is required")
+		}
 
-func loadEvents(doneChan chan int, pageChan chan Page, db *sql.DB) (int, error) {
-	for {
-		select {
-		case page := <-pageChan:
-			err := loadEventsPage(page, db)
+		db, err := sql.Open("postgres", conf.DatabaseURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Every command expects an up to date schema. The migrate command
+		// applies migrations itself because it may need to baseline the
+		// database first.
+		if os.Args[1] == "migrate" {
+			err = migrateCommand(db, conf, os.Args[2:])
 			if err != nil {
-				return 0, err
+				log.Fatal(err)
 			}
+			return
+		}
 
-		default:
-			select {
-			case numProcessed := <-doneChan:
-				return numProcessed, nil
-			default:
-				// If we didn't get a done signal, sleep for a short time just
-				// to keep this goroutine from spinning like crazy before the
-				// first batch of work comes in.
-				time.Sleep(1 * time.Second)
+		_, err = migrate(db, conf.MigrationsDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		switch os.Args[1] {
+		case "erase":
+			err = erase(db, conf, os.Args[2:])
+
+		case "load-fx-rates":
+			if fxRates == nil {
+				log.Fatal("FX_RATES_PATH is required")
+			}
+			err = writeFXRates(db, fxRates)
+
+		case "rebuild":
+			if len(os.Args) != 3 {
+				log.Fatal("Usage: consumer rebuild <table>")
 			}
+			err = rebuild(db, os.Args[2])
+
+		case "reconcile":
+			err = reconcile(db, conf, os.Args[2:])
+
+		case "refresh-aggregates":
+			err = refreshAllAggregates(db)
+
+		case "retry-dead-letters":
+			err = retryDeadLetters(db, conf.History, conf.Aggregates)
+
+		default:
+			err = fmt.Errorf("Unknown command: %v", os.Args[1])
 		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// With no decoders, nothing would ever drain the fetched pages and the
+	// pipeline would hang.
+	if conf.DecodeWorkers < 1 {
+		log.Fatalf("DECODE_WORKERS must be at least 1, but was %v", conf.DecodeWorkers)
+	}
+
+	source, err := newSource(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sink, err := newSink(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// On an interrupt, stop fetching and decoding, but let a page that's in
+	// the middle of being loaded finish so that we exit at a checkpoint.
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Printf("Interrupted. Finishing the in-flight page before exiting.")
+		cancel()
+	}()
+
+	start := time.Now()
+
+	numProcessed, numStale, err := loadEvents(ctx, conf, source, sink)
+
+	// Some sinks buffer writes and flush them on close, so closing is part
+	// of a successful run rather than just cleanup.
+	closeErr := sink.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if closeErr != nil {
+		log.Fatal(closeErr)
+	}
+
+	if ctx.Err() != nil {
+		log.Printf("Stopped early. Processed %v event(s) in %v (%v stale write(s) discarded).",
+			numProcessed, time.Now().Sub(start), numStale)
+		return
 	}
+
+	log.Printf("Reached end of the log. Processed %v event(s) in %v (%v stale write(s) discarded).",
+		numProcessed, time.Now().Sub(start), numStale)
 }
 
-func loadEventsPage(page Page, db *sql.DB) error {
+// Loads a decoded page of events in a single batch along with a checkpoint
+// of its last sequence so that a later run picks up right after it. Events
+// that failed to decode or map are written as dead letters instead of failing
+// the page. Returns the number of rows discarded as stale.
+func loadEventsPage(sink Sink, page *decodedPage) (int, error) {
 	startPage := time.Now()
-	tx, err := db.Begin()
+	events := page.page.Data
+
+	// Deliberately not tied to the pipeline's context: once a page has
+	// started loading, we want it to be committed even if we're shutting
+	// down.
+	batch, err := sink.Begin()
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer batch.Rollback()
 
-	statement, err := tx.Prepare(pq.CopyIn("charges",
-		"id", "amount", "created", "sequence"))
+	err = batch.ArchiveEvents(events)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	for _, event := range page.Data {
-		switch event.Type {
-		case "charge.created":
-			_, err = statement.Exec(
-				// TODO: deserialize to proper charge object
-				event.Data.Obj["id"].(string),
-				uint64(event.Data.Obj["amount"].(float64)),
-				time.Unix(int64(event.Data.Obj["created"].(float64)), 0),
-				// TODO: should actually be in its own table
-				event.Sequence,
-			)
+	numStale := 0
+	for _, table := range tables {
+		if len(page.rows[table]) == 0 {
+			continue
+		}
+
+		tableStale, err := batch.WriteRows(table, page.rows[table])
+		if err != nil {
+			return 0, err
 		}
+		numStale += tableStale
 	}
 
-	_, err = statement.Exec()
+	err = batch.WriteDeadLetters(page.deadLetters)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	err = statement.Close()
-	if err != nil {
-		return err
+	// An empty page has nothing to commit, and no sequence to checkpoint.
+	if len(events) == 0 {
+		return 0, nil
 	}
 
-	err = tx.Commit()
+	err = batch.Commit(events[len(events)-1].Sequence)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	log.Printf("Loaded page of %v event(s) in %v.",
-		len(page.Data), time.Now().Sub(startPage))
-	return nil
+	log.Printf("Loaded page of %v event(s) (%v dead lettered, %v stale) in %v.",
+		len(events), len(page.deadLetters), numStale, time.Now().Sub(startPage))
+	return numStale, nil
 }
 
-func requestEvents(stripeKey, stripeURL string, doneChan chan int, pageChan chan Page) error {
-	var sequence uint64
-	client := &http.Client{}
-	numProcessed := 0
-
-	for {
-		startPage := time.Now()
+// Appends every event in a page verbatim to the raw `events` table, creating
+// any monthly partitions that don't exist yet.
+//
+// Note that pq only allows a single COPY to be active per connection, so this
+// must be run to completion before any other COPY in the same transaction is
+// started.
+func archiveEvents(tx *sql.Tx, events []Event) error {
+	months := make(map[time.Time]bool)
+	for _, event := range events {
+		months[eventMonth(event)] = true
+	}
 
-		url := fmt.Sprintf("%s/v1/events?sequence=%v", stripeURL, sequence)
-		log.Printf("Requesting page: %v (sequence %v)", url, sequence)
+	for month := range months {
+		_, err := tx.Exec(fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS events_%s PARTITION OF events
+				FOR VALUES FROM ('%s') TO ('%s')`,
+			month.Format("2006_01"),
+			month.Format(time.RFC3339),
+			month.AddDate(0, 1, 0).Format(time.RFC3339),
+		))
+		if err != nil {
+			return err
+		}
+	}
 
-		req, err := http.NewRequest("GET", url, nil)
-		req.SetBasicAuth(stripeKey, "")
+	statement, err := tx.Prepare(pq.CopyIn("events",
+		"sequence", "id", "type", "created", "data"))
+	if err != nil {
+		return err
+	}
 
-		// Note that Go will automatically request gzip compression because we
-		// didn't explicitly add an `Accept-Encoding` header. The "endpoint"
-		// program supports this, so it's a good thing.
-		resp, err := client.Do(req)
+	for _, event := range events {
+		_, err = statement.Exec(
+			event.Sequence,
+			event.ID,
+			event.Type,
+			time.Unix(event.Created, 0).UTC(),
+			string(event.Raw),
+		)
 		if err != nil {
 			return err
 		}
+	}
+
+	_, err = statement.Exec()
+	if err != nil {
+		return err
+	}
+
+	return statement.Close()
+}
+
+// Returns the first instant of the month that an event was created in, which
+// determines the partition of `events` that it'll land in.
+func eventMonth(event Event) time.Time {
+	created := time.Unix(event.Created, 0).UTC()
+	return time.Date(created.Year(), created.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Requests pages of events from the server starting after the given sequence
+// (or from the beginning of the feed if it's nil) and sends them to out in
+// order until the end of the feed is reached or ctx is cancelled.
+func requestEvents(ctx context.Context, conf Conf, sequence *uint64, out chan<- fetchedPage) error {
+	client := &http.Client{Timeout: conf.RequestTimeout}
 
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("Non-200 response from server")
+	for index := 0; ; index++ {
+		startPage := time.Now()
+
+		url := fmt.Sprintf("%s/v1/events", conf.StripeURL)
+		if sequence != nil {
+			url = fmt.Sprintf("%s?sequence=%v", url, *sequence)
 		}
+		log.Printf("Requesting page: %v", url)
 
-		data, err := ioutil.ReadAll(resp.Body)
+		data, err := requestWithRetries(ctx, client, conf, url, "")
 		if err != nil {
 			return err
 		}
@@ -182,22 +462,22 @@ func requestEvents(stripeKey, stripeURL string, doneChan chan int, pageChan chan
 		}
 
 		log.Printf("Received page of %v event(s) in %v. Work queue depth is %v",
-			len(page.Data), time.Now().Sub(startPage), len(pageChan))
+			len(page.Data), time.Now().Sub(startPage), len(out))
 
-		pageChan <- page
+		select {
+		case out <- fetchedPage{index: index, page: page}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 
-		numProcessed += len(page.Data)
 		if !page.HasMore {
-			break
+			return nil
 		}
 
 		// Set sequence for the next page request.
 		if len(page.Data) > 0 {
-			sequence = page.Data[len(page.Data)-1].Sequence
+			last := page.Data[len(page.Data)-1].Sequence
+			sequence = &last
 		}
 	}
-
-	doneChan <- numProcessed
-
-	return nil
 }
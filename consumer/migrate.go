@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Arbitrary key for the advisory lock that's held while applying a migration
+// so that two consumers starting at once don't both try to apply it.
+const MigrationLockKey = 7310469812
+
+// Migration files are named with a version number followed by a name, like
+// `0002_add_currency.sql`.
+var migrationPattern = regexp.MustCompile(`^(\d+)_(\w+)\.sql$`)
+
+// Migration is a single numbered schema change.
+type Migration struct {
+	Version  int
+	Name     string
+	SQL      string
+	Checksum string
+}
+
+// Applies any migrations in dir that haven't yet been applied, each in its
+// own transaction, recording them in `schema_migrations`. Returns the number
+// of migrations applied.
+//
+// Migrations that were already applied are verified against the checksum
+// recorded when they were, and if any have been edited since, nothing is
+// applied. Migrations only go up: to undo a change, write a new migration.
+func migrate(db *sql.DB, dir string) (int, error) {
+	migrations, err := readMigrations(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	err = createMigrationsTable(db)
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+
+	// Applying the initial migration to a warehouse created from the old
+	// structure.sql, which created only `charges`, would fail with an error
+	// about a relation that already exists, so explain what to do instead.
+	if len(applied) == 0 {
+		var exists bool
+		err = db.QueryRow(`SELECT to_regclass('charges') IS NOT NULL`).Scan(&exists)
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			return 0, fmt.Errorf("The database has a schema but no migrations are recorded " +
+				"in schema_migrations. If it was created from structure.sql, run " +
+				"`consumer migrate -baseline 1` to record the initial migration as applied.")
+		}
+	}
+
+	for _, migration := range migrations {
+		checksum, ok := applied[migration.Version]
+		if ok && checksum != migration.Checksum {
+			return 0, fmt.Errorf("Migration %v (%v) has changed since it was applied. "+
+				"Write a new migration instead of editing an old one.",
+				migration.Version, migration.Name)
+		}
+	}
+
+	numApplied := 0
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		ok, err := applyMigration(db, migration)
+		if err != nil {
+			return numApplied, fmt.Errorf("Error applying migration %v (%v): %v",
+				migration.Version, migration.Name, err)
+		}
+		if ok {
+			numApplied++
+		}
+	}
+
+	// Reference data that's defined in code is synced along with the
+	// schema so that SQL that uses it is never out of date.
+	err = writeZeroDecimalCurrencies(db)
+	if err != nil {
+		return numApplied, err
+	}
+
+	return numApplied, nil
+}
+
+// Runs the migrate command, which applies any outstanding migrations. With
+// -baseline, migrations up to the given version are first recorded as
+// applied without being run, which adopts a warehouse whose schema was
+// created before migrations were tracked: one created from the old
+// structure.sql is at version 1.
+func migrateCommand(db *sql.DB, conf Conf, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	baseline := flags.Int("baseline", 0, "Record migrations up to this version as applied without running them")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return fmt.Errorf("Usage: consumer migrate [-baseline <version>]")
+	}
+
+	if *baseline > 0 {
+		err := baselineMigrations(db, conf.MigrationsDir, *baseline)
+		if err != nil {
+			return err
+		}
+	}
+
+	numApplied, err := migrate(db, conf.MigrationsDir)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Applied %v migration(s).", numApplied)
+	return nil
+}
+
+// Records every migration up to and including version as applied without
+// running it. Only a database with no migrations recorded can be baselined,
+// so that one that's already tracked never has migrations skipped.
+func baselineMigrations(db *sql.DB, dir string, version int) error {
+	migrations, err := readMigrations(dir)
+	if err != nil {
+		return err
+	}
+
+	err = createMigrationsTable(db)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, MigrationLockKey)
+	if err != nil {
+		return err
+	}
+
+	var numApplied int
+	err = tx.QueryRow(`SELECT count(*) FROM schema_migrations`).Scan(&numApplied)
+	if err != nil {
+		return err
+	}
+	if numApplied > 0 {
+		return fmt.Errorf("Can't baseline a database that already has %v migration(s) recorded",
+			numApplied)
+	}
+
+	numBaselined := 0
+	for _, migration := range migrations {
+		if migration.Version > version {
+			break
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO schema_migrations (version, name, checksum, applied_at)
+			VALUES ($1, $2, $3, now())`,
+			migration.Version, migration.Name, migration.Checksum)
+		if err != nil {
+			return err
+		}
+		numBaselined++
+	}
+
+	if numBaselined == 0 {
+		return fmt.Errorf("No migrations up to version %v to baseline", version)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Recorded %v migration(s) up to version %v as applied.", numBaselined, version)
+	return nil
+}
+
+func createMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version int PRIMARY KEY,
+			name text NOT NULL,
+			checksum text NOT NULL,
+			applied_at timestamptz NOT NULL
+		)`)
+	return err
+}
+
+// Applies a single migration. Returns false if it turned out that another
+// process applied it first.
+func applyMigration(db *sql.DB, migration *Migration) (bool, error) {
+	start := time.Now()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, MigrationLockKey)
+	if err != nil {
+		return false, err
+	}
+
+	// Now that we have the lock, check again in case someone else applied
+	// the migration while we were waiting for it.
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`,
+		migration.Version).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	_, err = tx.Exec(migration.SQL)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO schema_migrations (version, name, checksum, applied_at)
+		VALUES ($1, $2, $3, now())`,
+		migration.Version, migration.Name, migration.Checksum)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Applied migration %v (%v) in %v.",
+		migration.Version, migration.Name, time.Now().Sub(start))
+	return true, nil
+}
+
+// Returns the checksums of applied migrations keyed by version.
+func appliedMigrations(db *sql.DB) (map[int]string, error) {
+	rows, err := db.Query(`SELECT version, checksum FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var checksum string
+		err = rows.Scan(&version, &checksum)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = checksum
+	}
+	return applied, rows.Err()
+}
+
+// Reads migration files from dir ordered by version.
+func readMigrations(dir string) ([]*Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []*Migration
+	seen := make(map[int]string)
+	for _, file := range files {
+		matches := migrationPattern.FindStringSubmatch(file.Name())
+		if matches == nil {
+			continue
+		}
+
+		version, err := strconv.Atoi(matches[1])
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("Migrations %v and %v have the same version",
+				other, file.Name())
+		}
+		seen[version] = file.Name()
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(data)
+		migrations = append(migrations, &Migration{
+			Version:  version,
+			Name:     matches[2],
+			SQL:      string(data),
+			Checksum: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	// Name of the manifest file at the root of the Parquet directory.
+	ParquetManifestName = "_manifest.json"
+
+	// Number of goroutines that the Parquet writer uses to marshal rows.
+	ParquetWriterParallelism = 4
+)
+
+// Newline-delimited JSON files written alongside the Parquet files. Entries
+// are appended in sequence order.
+var parquetSideFiles = []string{"deletions.ndjson", "dead_letter_events.ndjson"}
+
+// parquetManifest records every completed Parquet file along with the range
+// of sequences that it contains. Only files in the manifest should be read;
+// anything else in the directory is a file that was being written when the
+// consumer stopped.
+type parquetManifest struct {
+	// Checkpoint is the sequence up to which every event is in a completed
+	// file, and where loading resumes from.
+	Checkpoint *uint64 `json:"checkpoint"`
+
+	Files []parquetManifestFile `json:"files"`
+}
+
+type parquetManifestFile struct {
+	Path        string    `json:"path"`
+	Table       string    `json:"table"`
+	Date        string    `json:"date"`
+	Rows        int       `json:"rows"`
+	MinSequence uint64    `json:"min_sequence"`
+	MaxSequence uint64    `json:"max_sequence"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// parquetFile is a Parquet file that's still being written.
+type parquetFile struct {
+	table       *Table
+	date        string
+	path        string
+	file        *os.File
+	writer      *writer.CSVWriter
+	rows        int
+	size        int64
+	minSequence uint64
+	maxSequence uint64
+}
+
+// parquetSink writes each typed table to Parquet files partitioned by the
+// date that objects were created:
+//
+//	charges/dt=2016-02-04/part-0001.parquet
+//
+// Files are rolled once they reach a target size. Parquet files can't be
+// appended to once they're closed, so a file that's in progress when the
+// consumer stops is discarded, and loading resumes from a checkpoint that
+// ensures its rows will be written again.
+type parquetSink struct {
+	dir      string
+	fileSize int64
+
+	manifest parquetManifest
+	open     map[string]*parquetFile
+
+	// Highest sequence in a completed file for each table and date. Rows at
+	// or below it are already written and are skipped when reloading after
+	// a resume.
+	completed map[string]uint64
+
+	// Sequence of the last batch committed.
+	committed *uint64
+}
+
+func newParquetSink(dir string, fileSize int64) (*parquetSink, error) {
+	sink := &parquetSink{
+		dir:       dir,
+		fileSize:  fileSize,
+		open:      make(map[string]*parquetFile),
+		completed: make(map[string]uint64),
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, ParquetManifestName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &sink.manifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, file := range sink.manifest.Files {
+		key := parquetKey(file.Table, file.Date)
+		if file.MaxSequence > sink.completed[key] {
+			sink.completed[key] = file.MaxSequence
+		}
+	}
+	sink.committed = sink.manifest.Checkpoint
+
+	// Loading resumes from the checkpoint, so entries after it will be
+	// appended again.
+	for _, name := range parquetSideFiles {
+		err = truncateAfterSequence(filepath.Join(dir, name), sink.manifest.Checkpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Clear out files that were in progress when we last stopped.
+	inProgress, err := filepath.Glob(filepath.Join(dir, "*", "*", "*.parquet.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range inProgress {
+		log.Printf("Removing incomplete Parquet file: %v", path)
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sink, nil
+}
+
+func (s *parquetSink) Begin() (Batch, error) {
+	return &parquetBatch{
+		sink:      s,
+		rows:      make(map[*Table][]Row),
+		deletions: make(map[*Table][]Row),
+	}, nil
+}
+
+func (s *parquetSink) Checkpoint() (*uint64, error) {
+	return s.manifest.Checkpoint, nil
+}
+
+// Close completes every open file so that a clean shutdown leaves nothing to
+// be rewritten.
+func (s *parquetSink) Close() error {
+	var keys []string
+	for key := range s.open {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		err := s.complete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes rows to the open file for their table and date, rolling files that
+// have reached the target size.
+//
+// Unlike the SQL sinks, rows aren't replaced when their object changes, so
+// the files hold every version of each object with its sequence. Child rows
+// are written under the date of their parent, and the current items of a
+// parent's list are those with the parent's latest sequence.
+func (s *parquetSink) write(table *Table, rows []Row) error {
+	createdIndex := columnIndex(table, "created")
+	if createdIndex < 0 {
+		return fmt.Errorf("Table %v needs a created column to be written to Parquet",
+			table.Name)
+	}
+
+	for _, row := range rows {
+		date := row.Values[createdIndex].(time.Time).UTC().Format("2006-01-02")
+
+		err := s.writeValues(table, date, row.Event.Sequence, row.Values)
+		if err != nil {
+			return err
+		}
+
+		for _, child := range table.Children {
+			for _, values := range row.Children[child] {
+				err = s.writeValues(child, date, row.Event.Sequence, values)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Writes a single row to the open file for its table and date.
+func (s *parquetSink) writeValues(table *Table, date string, sequence uint64, rowValues []interface{}) error {
+	key := parquetKey(table.Name, date)
+
+	// Already in a completed file from before we resumed.
+	if completed, ok := s.completed[key]; ok && sequence <= completed {
+		return nil
+	}
+
+	file, ok := s.open[key]
+	if !ok {
+		var err error
+		file, err = s.create(table, date)
+		if err != nil {
+			return err
+		}
+		s.open[key] = file
+		file.minSequence = sequence
+	}
+
+	values := make([]interface{}, len(rowValues))
+	for i, column := range table.Columns {
+		values[i] = parquetValue(column.Type, rowValues[i])
+		file.size += parquetValueSize(values[i])
+	}
+
+	err := file.writer.Write(values)
+	if err != nil {
+		return err
+	}
+	file.rows++
+	file.maxSequence = sequence
+
+	if file.size >= s.fileSize {
+		return s.complete(key)
+	}
+	return nil
+}
+
+func (s *parquetSink) create(table *Table, date string) (*parquetFile, error) {
+	dir := filepath.Join(s.dir, table.Name, "dt="+date)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := filepath.Glob(filepath.Join(dir, "part-*.parquet"))
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("part-%04d.parquet", len(existing)+1))
+
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata []string
+	for _, column := range table.Columns {
+		metadata = append(metadata, parquetColumnMetadata(column))
+	}
+
+	w, err := writer.NewCSVWriterFromWriter(metadata, file, ParquetWriterParallelism)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &parquetFile{table: table, date: date, path: path, file: file, writer: w}, nil
+}
+
+// Finishes an open file, moves it into place, and records it in the manifest
+// along with a new checkpoint.
+func (s *parquetSink) complete(key string) error {
+	file := s.open[key]
+	delete(s.open, key)
+
+	err := file.writer.WriteStop()
+	if err != nil {
+		return err
+	}
+
+	err = file.file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(file.path+".tmp", file.path)
+	if err != nil {
+		return err
+	}
+
+	relativePath, err := filepath.Rel(s.dir, file.path)
+	if err != nil {
+		return err
+	}
+
+	s.completed[key] = file.maxSequence
+	s.manifest.Files = append(s.manifest.Files, parquetManifestFile{
+		Path:        relativePath,
+		Table:       file.table.Name,
+		Date:        file.date,
+		Rows:        file.rows,
+		MinSequence: file.minSequence,
+		MaxSequence: file.maxSequence,
+		CompletedAt: time.Now().UTC(),
+	})
+
+	// Everything committed is durable except for what's in files that are
+	// still open, so the checkpoint is just before the earliest row in any
+	// of them.
+	checkpoint := s.committed
+	for _, open := range s.open {
+		if open.minSequence == 0 {
+			checkpoint = nil
+			break
+		}
+		if checkpoint != nil && open.minSequence-1 < *checkpoint {
+			c := open.minSequence - 1
+			checkpoint = &c
+		}
+	}
+	s.manifest.Checkpoint = checkpoint
+
+	log.Printf("Completed Parquet file: %v (%v row(s), sequences %v to %v)",
+		relativePath, file.rows, file.minSequence, file.maxSequence)
+	return s.writeManifest()
+}
+
+// Writes the manifest atomically so that a crash never leaves it half
+// written.
+func (s *parquetSink) writeManifest() error {
+	data, err := json.MarshalIndent(s.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, ParquetManifestName)
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// parquetBatch holds rows in memory until it's committed because rows can't
+// be taken back out of a Parquet file once they're written.
+type parquetBatch struct {
+	sink        *parquetSink
+	tables      []*Table
+	rows        map[*Table][]Row
+	deletions   map[*Table][]Row
+	deadLetters []DeadLetter
+}
+
+// ArchiveEvents does nothing. The Parquet sink only writes typed tables.
+func (b *parquetBatch) ArchiveEvents(events []Event) error {
+	return nil
+}
+
+// WriteRows holds rows to be written on commit. Parquet files can't have rows
+// removed, so rows of deleted objects are instead appended to a
+// newline-delimited JSON file of deletions alongside the Parquet files. Every
+// version of an object is kept with its sequence and event created time, so
+// no row is ever stale.
+func (b *parquetBatch) WriteRows(table *Table, rows []Row) (int, error) {
+	if _, ok := b.rows[table]; !ok {
+		b.tables = append(b.tables, table)
+	}
+	rows, deletions := splitDeletions(rows)
+	b.rows[table] = append(b.rows[table], rows...)
+	b.deletions[table] = append(b.deletions[table], deletions...)
+	return 0, nil
+}
+
+// WriteDeadLetters holds dead letters to be appended to a newline-delimited
+// JSON file alongside the Parquet files on commit.
+func (b *parquetBatch) WriteDeadLetters(deadLetters []DeadLetter) error {
+	b.deadLetters = append(b.deadLetters, deadLetters...)
+	return nil
+}
+
+func (b *parquetBatch) Commit(sequence uint64) error {
+	for _, table := range b.tables {
+		err := b.sink.write(table, b.rows[table])
+		if err != nil {
+			return err
+		}
+	}
+	b.rows = nil
+
+	var deletions []parquetDeletion
+	for _, table := range b.tables {
+		for _, row := range b.deletions[table] {
+			deletions = append(deletions, parquetDeletion{table, row})
+		}
+	}
+	if len(deletions) > 0 {
+		sort.SliceStable(deletions, func(i, j int) bool {
+			return deletions[i].Row.Event.Sequence < deletions[j].Row.Event.Sequence
+		})
+
+		err := appendDeletions(filepath.Join(b.sink.dir, "deletions.ndjson"), deletions)
+		if err != nil {
+			return err
+		}
+	}
+	b.deletions = nil
+
+	if len(b.deadLetters) > 0 {
+		err := appendDeadLetters(filepath.Join(b.sink.dir, "dead_letter_events.ndjson"),
+			b.deadLetters)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.sink.committed = &sequence
+	if len(b.sink.open) == 0 {
+		b.sink.manifest.Checkpoint = &sequence
+		return b.sink.writeManifest()
+	}
+	return nil
+}
+
+func (b *parquetBatch) Rollback() error {
+	b.rows = nil
+	b.deletions = nil
+	b.deadLetters = nil
+	return nil
+}
+
+// parquetDeletion is the row of a deleted object along with its table.
+type parquetDeletion struct {
+	Table *Table
+	Row   Row
+}
+
+// Appends the keys of deleted objects to a file as newline-delimited JSON.
+func appendDeletions(path string, deletions []parquetDeletion) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, deletion := range deletions {
+		row := deletion.Row
+		err = encoder.Encode(map[string]interface{}{
+			"table":      deletion.Table.Name,
+			"account_id": row.Event.Account,
+			"id":         row.Values[columnIndex(deletion.Table, "id")],
+			"sequence":   row.Event.Sequence,
+			"deleted_at": time.Unix(row.Event.Created, 0).UTC(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Appends dead letters to a file as newline-delimited JSON.
+func appendDeadLetters(path string, deadLetters []DeadLetter) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, deadLetter := range deadLetters {
+		err = encoder.Encode(map[string]interface{}{
+			"sequence":  deadLetter.Event.Sequence,
+			"id":        deadLetter.Event.ID,
+			"type":      deadLetter.Event.Type,
+			"error":     deadLetter.Err.Error(),
+			"data":      deadLetter.Event.Raw,
+			"failed_at": time.Now().UTC(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return file.Sync()
+}
+
+// Truncates a newline-delimited JSON file written in sequence order just
+// before its first entry after checkpoint, or before a partial entry left by
+// a crash, so that loading again from the checkpoint doesn't duplicate
+// entries. Everything is removed if there's no checkpoint.
+func truncateAfterSequence(path string, checkpoint *uint64) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var offset int64
+	reader := bufio.NewReader(file)
+	for checkpoint != nil {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var entry struct {
+			Sequence *uint64 `json:"sequence"`
+		}
+		err = json.Unmarshal(line, &entry)
+		if err != nil || entry.Sequence == nil || *entry.Sequence > *checkpoint {
+			break
+		}
+		offset += int64(len(line))
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if offset == info.Size() {
+		return nil
+	}
+
+	log.Printf("Truncating %v to the checkpoint (%v byte(s) removed)", path, info.Size()-offset)
+	err = file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func parquetKey(table, date string) string {
+	return table + "/" + date
+}
+
+// Returns the metadata describing a column to the Parquet writer. Every
+// column is optional so that nulls can be represented.
+func parquetColumnMetadata(column Column) string {
+	var parts []string
+	switch column.Type {
+	case BigintColumn:
+		parts = []string{"type=INT64"}
+	case BooleanColumn:
+		parts = []string{"type=BOOLEAN"}
+	case NumericColumn:
+		parts = []string{"type=DOUBLE"}
+	case TimestampColumn:
+		parts = []string{"type=INT64", "convertedtype=TIMESTAMP_MILLIS"}
+	default:
+		parts = []string{"type=BYTE_ARRAY", "convertedtype=UTF8"}
+	}
+
+	return strings.Join(append([]string{"name=" + column.Name},
+		append(parts, "repetitiontype=OPTIONAL")...), ", ")
+}
+
+// Converts a row value to the Go type that the Parquet writer expects for a
+// column.
+func parquetValue(columnType ColumnType, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	switch columnType {
+	case BigintColumn:
+		switch v := value.(type) {
+		case int64:
+			return v
+		case uint64:
+			return int64(v)
+		case int:
+			return int64(v)
+		}
+	case BooleanColumn:
+		if b, ok := value.(bool); ok {
+			return b
+		}
+	case NumericColumn:
+		if s, ok := value.(string); ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return f
+			}
+		}
+	case TimestampColumn:
+		if t, ok := value.(time.Time); ok {
+			return t.UnixNano() / int64(time.Millisecond)
+		}
+	}
+
+	return fmt.Sprint(value)
+}
+
+// Estimates the number of bytes that a value adds to a file for the purposes
+// of rolling. It's only approximate because of compression and encoding, but
+// it doesn't need to be exact.
+func parquetValueSize(value interface{}) int64 {
+	if s, ok := value.(string); ok {
+		return int64(len(s))
+	}
+	return 8
+}
+
+func columnIndex(table *Table, name string) int {
+	for i, column := range table.Columns {
+		if column.Name == name {
+			return i
+		}
+	}
+	return -1
+}
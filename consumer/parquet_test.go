@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestTruncateAfterSequence(t *testing.T) {
+	contents := `{"sequence":1,"id":"ch_1"}` + "\n" +
+		`{"sequence":2,"id":"ch_2"}` + "\n" +
+		`{"sequence":2,"id":"ch_3"}` + "\n" +
+		`{"sequence":4,"id":"ch_4"}` + "\n"
+
+	checkpoint := func(sequence uint64) *uint64 { return &sequence }
+
+	testCases := []struct {
+		name       string
+		contents   string
+		checkpoint *uint64
+		want       string
+	}{
+		{
+			name:       "NothingAfterCheckpoint",
+			contents:   contents,
+			checkpoint: checkpoint(4),
+			want:       contents,
+		},
+		{
+			name:       "EntriesAfterCheckpoint",
+			contents:   contents,
+			checkpoint: checkpoint(3),
+			want:       contents[:len(contents)-len(`{"sequence":4,"id":"ch_4"}`+"\n")],
+		},
+		{
+			name:       "NoCheckpoint",
+			contents:   contents,
+			checkpoint: nil,
+			want:       "",
+		},
+		{
+			name:       "PartialEntry",
+			contents:   contents + `{"sequence":5,"id`,
+			checkpoint: checkpoint(9),
+			want:       contents,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "deletions.ndjson")
+			err := ioutil.WriteFile(path, []byte(testCase.contents), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = truncateAfterSequence(path, testCase.checkpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != testCase.want {
+				t.Errorf("Expected %q, got %q", testCase.want, data)
+			}
+		})
+	}
+
+	err := truncateAfterSequence(filepath.Join(t.TempDir(), "missing.ndjson"), nil)
+	if err != nil {
+		t.Errorf("Expected a missing file to be ignored, got %v", err)
+	}
+}
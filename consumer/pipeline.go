@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// fetchedPage is a page of events as it came off the feed. index is its
+// position in the run so that pages can be committed in order no matter which
+// order they come out of decoding.
+type fetchedPage struct {
+	index int
+	page  Page
+}
+
+// decodedPage is a page of events that's been decoded and mapped to rows and
+// is ready to be loaded.
+type decodedPage struct {
+	index       int
+	page        Page
+	rows        map[*Table][]Row
+	deadLetters []DeadLetter
+}
+
+// Loads events from a source into a sink through a pipeline of three
+// stages:
+//
+//	fetch -> decode (DECODE_WORKERS goroutines) -> load
+//
+// The stages are connected by bounded channels so that a slow stage applies
+// backpressure to those before it. Pages are loaded strictly in the order
+// that they were fetched, each in a transaction that also records a
+// checkpoint, and loading resumes from the last checkpoint.
+//
+// The first error from any stage stops the pipeline and is returned.
+// Cancelling ctx also stops it, but a page that's already being loaded is
+// committed first. Returns the number of events loaded, and the number of rows
+// rejected because they were older than what was already stored.
+func loadEvents(ctx context.Context, conf Conf, source Source, sink Sink) (int, int, error) {
+	sequence, err := sink.Checkpoint()
+	if err != nil {
+		return 0, 0, err
+	}
+	if sequence != nil {
+		log.Printf("Resuming from checkpoint at sequence %v", *sequence)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fetched := make(chan fetchedPage, PageBuffer)
+	decoded := make(chan *decodedPage, PageBuffer)
+	var wg sync.WaitGroup
+
+	var fetchErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(fetched)
+
+		err := source.Stream(ctx, sequence, fetched)
+
+		// An error after cancellation is just the cancellation itself.
+		if err != nil && ctx.Err() == nil {
+			fetchErr = err
+			cancel()
+		}
+	}()
+
+	var decodeErr error
+	var decodeErrOnce sync.Once
+	var decoders sync.WaitGroup
+	for i := 0; i < conf.DecodeWorkers; i++ {
+		decoders.Add(1)
+		go func() {
+			defer decoders.Done()
+
+			err := decodePages(ctx, fetched, decoded)
+			if err != nil {
+				decodeErrOnce.Do(func() { decodeErr = err })
+				cancel()
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		decoders.Wait()
+		close(decoded)
+	}()
+
+	numLoaded, numStale, err := loadPages(ctx, sink, conf.DeadLetterMaxRate, decoded)
+	if err != nil {
+		cancel()
+	}
+
+	// Make sure that every stage has exited before returning so that
+	// nothing's left running against a database that the caller may close.
+	wg.Wait()
+
+	if err != nil {
+		return numLoaded, numStale, err
+	}
+	if fetchErr != nil {
+		return numLoaded, numStale, fetchErr
+	}
+	if decodeErr != nil {
+		return numLoaded, numStale, decodeErr
+	}
+	return numLoaded, numStale, nil
+}
+
+// Redacts, decodes, and maps pages until in is closed or ctx is cancelled.
+// Any number of these may run concurrently.
+//
+// An event that can't be redacted is an error rather than a dead letter
+// because a dead letter would keep the information that was supposed to be
+// redacted.
+func decodePages(ctx context.Context, in <-chan fetchedPage, out chan<- *decodedPage) error {
+	for fetched := range in {
+		for i := range fetched.page.Data {
+			err := redactEvent(&fetched.page.Data[i])
+			if err != nil {
+				return fmt.Errorf("Couldn't redact event %v: %v", fetched.page.Data[i].ID, err)
+			}
+		}
+
+		rows, deadLetters := mapEvents(fetched.page.Data)
+
+		select {
+		case out <- &decodedPage{
+			index:       fetched.index,
+			page:        fetched.page,
+			rows:        rows,
+			deadLetters: deadLetters,
+		}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// Loads decoded pages in order until in is closed or ctx is cancelled,
+// returning the number of events loaded and of stale rows rejected. Pages
+// that arrive ahead of their turn are held until every page before them has
+// been committed.
+func loadPages(ctx context.Context, sink Sink, maxDeadLetterRate float64, in <-chan *decodedPage) (int, int, error) {
+	var numLoaded, numDeadLettered, numStale int
+	pending := make(map[int]*decodedPage)
+	next := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return numLoaded, numStale, nil
+
+		case page, ok := <-in:
+			if !ok {
+				return numLoaded, numStale, nil
+			}
+			pending[page.index] = page
+
+			for {
+				page, ok := pending[next]
+				if !ok {
+					break
+				}
+
+				// Check between pages so that a shutdown stops right after
+				// the transaction that was in flight.
+				if ctx.Err() != nil {
+					return numLoaded, numStale, nil
+				}
+
+				pageStale, err := loadEventsPage(sink, page)
+				if err != nil {
+					return numLoaded, numStale, err
+				}
+
+				delete(pending, next)
+				next++
+
+				numLoaded += len(page.page.Data)
+				numDeadLettered += len(page.deadLetters)
+				numStale += pageStale
+
+				rate := float64(numDeadLettered) / float64(numLoaded)
+				if numLoaded >= DeadLetterRateMinEvents && rate > maxDeadLetterRate {
+					return numLoaded, numStale, fmt.Errorf("Dead lettered %v of %v event(s), "+
+						"which is over the maximum rate of %v. Halting.",
+						numDeadLettered, numLoaded, maxDeadLetterRate)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresSink loads into Postgres using COPY. Its schema is managed by the
+// migrations in db/migrations, which are applied when the sink is opened.
+type postgresSink struct {
+	db         *sql.DB
+	history    bool
+	aggregates bool
+}
+
+func newPostgresSink(databaseURL, migrationsDir string, history, aggregates bool) (*postgresSink, error) {
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = migrate(db, migrationsDir)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &postgresSink{db: db, history: history, aggregates: aggregates}, nil
+}
+
+func (s *postgresSink) Begin() (Batch, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	batch := &postgresBatch{tx: tx, history: s.history}
+	if s.aggregates {
+		batch.touched = make(touchedDays)
+	}
+	return batch, nil
+}
+
+func (s *postgresSink) Checkpoint() (*uint64, error) {
+	return readCheckpoint(s.db)
+}
+
+func (s *postgresSink) Close() error {
+	return s.db.Close()
+}
+
+type postgresBatch struct {
+	tx      *sql.Tx
+	history bool
+
+	// Days whose aggregates need to be refreshed before commit. Nil if
+	// aggregates are disabled.
+	touched touchedDays
+}
+
+func (b *postgresBatch) ArchiveEvents(events []Event) error {
+	return archiveEvents(b.tx, events)
+}
+
+func (b *postgresBatch) WriteRows(table *Table, rows []Row) (int, error) {
+	if b.touched != nil {
+		err := b.touched.addStoredRows(b.tx, table, rows)
+		if err != nil {
+			return 0, err
+		}
+		b.touched.addRows(table, rows)
+	}
+	return upsertTableRows(b.tx, table, "", rows, b.history)
+}
+
+func (b *postgresBatch) WriteDeadLetters(deadLetters []DeadLetter) error {
+	return writeDeadLetters(b.tx, deadLetters)
+}
+
+// Commit refreshes the aggregates for any days that the batch touched so that
+// they're always consistent with the checkpoint.
+func (b *postgresBatch) Commit(sequence uint64) error {
+	err := refreshAggregates(b.tx, b.touched)
+	if err != nil {
+		return err
+	}
+
+	err = writeCheckpoint(b.tx, sequence)
+	if err != nil {
+		return err
+	}
+	return b.tx.Commit()
+}
+
+func (b *postgresBatch) Rollback() error {
+	err := b.tx.Rollback()
+	if err == sql.ErrTxDone {
+		return nil
+	}
+	return err
+}
+
+// Returns the sequence of the last event loaded, or nil if nothing has been
+// loaded yet.
+func readCheckpoint(db *sql.DB) (*uint64, error) {
+	var sequence int64
+	err := db.QueryRow(`SELECT sequence FROM checkpoints WHERE name = 'feed'`).
+		Scan(&sequence)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := uint64(sequence)
+	return &s, nil
+}
+
+func writeCheckpoint(tx *sql.Tx, sequence uint64) error {
+	_, err := tx.Exec(`
+		INSERT INTO checkpoints (name, sequence, updated_at)
+		VALUES ('feed', $1, now())
+		ON CONFLICT (name) DO UPDATE SET
+			sequence = excluded.sequence,
+			updated_at = excluded.updated_at`,
+		sequence)
+	return err
+}
+
+// Upserts rows into the table, or into a shadow copy of it being rebuilt if
+// suffix is set, and replaces the rows of its child tables (or their shadow
+// copies). Rows of deleted objects are removed, and the deletion is recorded
+// in `deletions`.
+//
+// A row that's older than the one already stored for its object (by event
+// created time and then sequence), or that wasn't created after the object's
+// deletion, is stale, and is rejected rather than written. Deletions are
+// applied first so that writes in the same page are checked against them.
+// Returns the number of stale rows.
+//
+// If history is set, every version is also recorded in the table's history
+// table, and the version that was previously current is closed off.
+func upsertTableRows(tx *sql.Tx, table *Table, suffix string, rows []Row, history bool) (int, error) {
+	rows, deletions := splitDeletions(rows)
+
+	err := deleteTableRows(tx, table, suffix, deletions, history)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	return mergeTableRows(tx, table, suffix, rows, history)
+}
+
+// Merges rows into the table. Rows are COPYed into a temporary staging table
+// first so that the whole page can be merged with a few statements instead of
+// one per row. When an object appears more than once in the page, only its
+// latest version makes it into the table.
+func mergeTableRows(tx *sql.Tx, table *Table, suffix string, rows []Row, history bool) (int, error) {
+	target := table.Name + suffix
+	staging := "staging_" + target
+	columns := strings.Join(table.ColumnNames(), ", ")
+	key := strings.Join(table.Key, ", ")
+
+	// Staging tables are dropped on commit, but a page that failed part way
+	// through may have left one behind in the same transaction.
+	statements := []string{
+		fmt.Sprintf(`DROP TABLE IF EXISTS %s`, staging),
+		fmt.Sprintf(`CREATE TEMP TABLE %s (LIKE %s) ON COMMIT DROP`, staging, target),
+	}
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	statement, err := tx.Prepare(pq.CopyIn(staging, table.ColumnNames()...))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, row := range rows {
+		_, err = statement.Exec(row.Values...)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = statement.Exec()
+	if err != nil {
+		return 0, err
+	}
+
+	err = statement.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, numStale, err := rejectStaleRows(tx, table, target, staging, rows)
+	if err != nil {
+		return 0, err
+	}
+
+	if history {
+		var conditions []string
+		for _, name := range table.Key {
+			conditions = append(conditions, fmt.Sprintf("h.%s = s.%s", name, name))
+		}
+
+		// Close the current version of each object using the first of its
+		// new versions in the page.
+		_, err = tx.Exec(fmt.Sprintf(`
+			UPDATE %s h SET
+				valid_to_sequence = s.sequence,
+				valid_to = s.event_created
+			FROM (
+				SELECT DISTINCT ON (%s) %s, sequence, event_created
+				FROM %s
+				ORDER BY %s, sequence
+			) s
+			WHERE %s
+				AND h.valid_to_sequence IS NULL
+				AND h.valid_from_sequence < s.sequence`,
+			table.HistoryName(), key, key, staging, key,
+			strings.Join(conditions, " AND ")))
+		if err != nil {
+			return 0, err
+		}
+
+		// Each new version is valid until the next one in the page, and the
+		// last is left open. Versions that are already in the history are
+		// skipped so that a page can be safely reloaded.
+		_, err = tx.Exec(fmt.Sprintf(`
+			INSERT INTO %s (%s,
+				valid_from_sequence, valid_to_sequence, valid_from, valid_to)
+			SELECT %s,
+				sequence, lead(sequence) OVER w,
+				event_created, lead(event_created) OVER w
+			FROM %s
+			WINDOW w AS (PARTITION BY %s ORDER BY sequence)
+			ON CONFLICT DO NOTHING`,
+			table.HistoryName(), columns, columns, staging, key))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var assignments []string
+	for _, name := range table.NonKeyColumnNames() {
+		assignments = append(assignments, fmt.Sprintf("%s = excluded.%s", name, name))
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(`
+		INSERT INTO %s (%s)
+		SELECT DISTINCT ON (%s) %s
+		FROM %s
+		ORDER BY %s, event_created DESC, sequence DESC
+		ON CONFLICT (%s) DO UPDATE SET %s`,
+		target, columns, key, columns, staging, key, key,
+		strings.Join(assignments, ", ")))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, child := range table.Children {
+		err = replaceChildRows(tx, table, child, child.Name+suffix, rows)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return numStale, nil
+}
+
+// Removes rows from staging that are older than the row already in target
+// for the same object, or no newer than the object's deletion, so that they
+// don't overwrite it, its child rows, or its history. Rows from before
+// event_created was recorded are always considered older. Returns the rows
+// that are left and the number removed.
+func rejectStaleRows(tx *sql.Tx, table *Table, target, staging string, rows []Row) ([]Row, int, error) {
+	var conditions []string
+	for _, name := range table.Key {
+		conditions = append(conditions, fmt.Sprintf("s.%s = t.%s", name, name))
+	}
+
+	var returning []string
+	for _, name := range table.Key {
+		returning = append(returning, "s."+name)
+	}
+
+	stale := make(map[string]bool)
+	err := collectStaleRows(tx, table, stale, fmt.Sprintf(`
+		DELETE FROM %s s
+		USING %s t
+		WHERE %s
+			AND (coalesce(t.event_created, '-infinity'), t.sequence)
+				> (s.event_created, s.sequence)
+		RETURNING %s, s.sequence`,
+		staging, target, strings.Join(conditions, " AND "),
+		strings.Join(returning, ", ")))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Objects don't come back once they're deleted, so only a write created
+	// strictly after the deletion survives it. Sequence isn't a tiebreaker
+	// here because a write replayed from before the deletion has a higher
+	// sequence than it.
+	err = collectStaleRows(tx, table, stale, fmt.Sprintf(`
+		DELETE FROM %s s
+		USING deletions t
+		WHERE t.table_name = $1
+			AND %s
+			AND t.event_created >= s.event_created
+		RETURNING %s, s.sequence`,
+		staging, strings.Join(conditions, " AND "),
+		strings.Join(returning, ", ")), table.Name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(stale) == 0 {
+		return rows, 0, nil
+	}
+
+	var fresh []Row
+	numStale := 0
+	for _, row := range rows {
+		if stale[staleKey(table.KeyValues(row.Values), row.Event.Sequence)] {
+			numStale++
+			continue
+		}
+		fresh = append(fresh, row)
+	}
+	return fresh, numStale, nil
+}
+
+// Runs a statement that removes stale rows from staging and returns their
+// keys and sequences, adding each to stale.
+func collectStaleRows(tx *sql.Tx, table *Table, stale map[string]bool, query string, args ...interface{}) error {
+	result, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+
+	for result.Next() {
+		keyValues := make([]interface{}, len(table.Key))
+		pointers := make([]interface{}, len(table.Key)+1)
+		for i := range keyValues {
+			pointers[i] = &keyValues[i]
+		}
+		var sequence int64
+		pointers[len(table.Key)] = &sequence
+
+		err = result.Scan(pointers...)
+		if err != nil {
+			return err
+		}
+
+		for i, value := range keyValues {
+			if b, ok := value.([]byte); ok {
+				keyValues[i] = string(b)
+			}
+		}
+		stale[staleKey(keyValues, uint64(sequence))] = true
+	}
+	return result.Err()
+}
+
+// Identifies a version of an object by its key and sequence.
+func staleKey(keyValues []interface{}, sequence uint64) string {
+	return fmt.Sprintf("%q/%v", keyValues, sequence)
+}
+
+// Deletes the rows of deleted objects along with their child rows, and
+// records each deletion so that older writes of the object are rejected
+// later. A row that's newer than the deletion is left alone. With history,
+// the object's current version is closed at its deletion and no version is
+// left open.
+func deleteTableRows(tx *sql.Tx, table *Table, suffix string, deletions []Row, history bool) error {
+	for _, deletion := range deletions {
+		keyValues := table.KeyValues(deletion.Values)
+		created := time.Unix(deletion.Event.Created, 0).UTC()
+
+		_, err := tx.Exec(fmt.Sprintf(`
+			INSERT INTO deletions (table_name, %s, event_created, sequence)
+			VALUES ($1, %s, $%v, $%v)
+			ON CONFLICT (table_name, %s) DO UPDATE SET
+				event_created = excluded.event_created,
+				sequence = excluded.sequence
+			WHERE (deletions.event_created, deletions.sequence)
+				< (excluded.event_created, excluded.sequence)`,
+			strings.Join(table.Key, ", "), placeholders(2, len(table.Key)),
+			len(table.Key)+2, len(table.Key)+3, strings.Join(table.Key, ", ")),
+			append(append([]interface{}{table.Name}, keyValues...),
+				created, deletion.Event.Sequence)...)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(fmt.Sprintf(`
+			DELETE FROM %s
+			WHERE %s
+				AND (coalesce(event_created, '-infinity'), sequence) <= ($%v, $%v)`,
+			table.Name+suffix, keyConditions(table.Key, 1),
+			len(table.Key)+1, len(table.Key)+2),
+			append(append([]interface{}(nil), keyValues...),
+				created, deletion.Event.Sequence)...)
+		if err != nil {
+			return err
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			continue
+		}
+
+		// Foreign keys cascade the deletion to child tables, but the shadow
+		// copies of a rebuild don't have them.
+		for _, child := range table.Children {
+			_, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s`,
+				child.Name+suffix, keyConditions(child.ParentKey, 1)), keyValues...)
+			if err != nil {
+				return err
+			}
+		}
+
+		if history {
+			_, err = tx.Exec(fmt.Sprintf(`
+				UPDATE %s SET
+					valid_to_sequence = $1,
+					valid_to = $2
+				WHERE %s
+					AND valid_to_sequence IS NULL
+					AND valid_from_sequence < $1`,
+				table.HistoryName(), keyConditions(table.Key, 3)),
+				append([]interface{}{deletion.Event.Sequence, created}, keyValues...)...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns conditions matching each of columns to a placeholder, starting
+// from $start.
+func keyConditions(columns []string, start int) string {
+	var conditions []string
+	for i, name := range columns {
+		conditions = append(conditions, fmt.Sprintf("%s = $%v", name, start+i))
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// Returns n comma-separated placeholders numbered from start.
+func placeholders(start, n int) string {
+	placeholders := make([]string, n)
+	for i := range placeholders {
+		placeholders[i] = fmt.Sprintf("$%v", start+i)
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+// Replaces the rows in target for each parent in rows that carried the child
+// table's list with those from the parent's latest version.
+func replaceChildRows(tx *sql.Tx, table, child *Table, target string, rows []Row) error {
+	replacements := latestChildRows(table, child, rows)
+	if len(replacements) == 0 {
+		return nil
+	}
+
+	var conditions []string
+	for i, key := range child.ParentKey {
+		conditions = append(conditions, fmt.Sprintf("%s = $%v", key, i+1))
+	}
+
+	statement, err := tx.Prepare(fmt.Sprintf(`DELETE FROM %s WHERE %s`,
+		target, strings.Join(conditions, " AND ")))
+	if err != nil {
+		return err
+	}
+
+	for _, replacement := range replacements {
+		_, err = statement.Exec(replacement.ParentKey...)
+		if err != nil {
+			statement.Close()
+			return err
+		}
+	}
+
+	err = statement.Close()
+	if err != nil {
+		return err
+	}
+
+	statement, err = tx.Prepare(pq.CopyIn(target, child.ColumnNames()...))
+	if err != nil {
+		return err
+	}
+
+	for _, replacement := range replacements {
+		for _, values := range replacement.Rows {
+			_, err = statement.Exec(values...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = statement.Exec()
+	if err != nil {
+		return err
+	}
+
+	return statement.Close()
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Rebuilds a typed table from the raw event archive without touching the
+// network. Events are replayed through the table's normal mapping into a
+// shadow table, which is then swapped in for the original in a single
+// transaction so that readers never see a partially built table. A table's
+// child tables are rebuilt and swapped in along with it, and their foreign
+// keys on it are recreated.
+func rebuild(db *sql.DB, name string) error {
+	table := findTable(name)
+	if table == nil {
+		return fmt.Errorf("Unknown table: %v", name)
+	}
+
+	start := time.Now()
+	rebuilt := append([]*Table{table}, table.Children...)
+	shadow := table.Name + RebuildSuffix
+
+	for _, t := range rebuilt {
+		// Clear out any shadow left behind by a previous run that didn't
+		// finish.
+		_, err := db.Exec(fmt.Sprintf(`DROP TABLE IF EXISTS %s`,
+			pq.QuoteIdentifier(t.Name+RebuildSuffix)))
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec(fmt.Sprintf(`CREATE TABLE %s (LIKE %s INCLUDING ALL)`,
+			pq.QuoteIdentifier(t.Name+RebuildSuffix), pq.QuoteIdentifier(t.Name)))
+		if err != nil {
+			return err
+		}
+	}
+
+	// The bulk of the work happens outside of the final transaction so that
+	// the live table isn't locked while we're replaying.
+	var numProcessed int
+	var sequence int64 = -1
+	for {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		lastSequence, n, err := replayEvents(tx, table, sequence)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			break
+		}
+
+		numProcessed += n
+		sequence = lastSequence
+		log.Printf("Working. Replayed %v event(s) into %v.", numProcessed, shadow)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Hold the live tables while we pick up any events that were archived
+	// while we were replaying and then swap. The consumer writes the archive
+	// and the typed tables in the same transaction, so anything it commits
+	// from here will be waiting on this lock.
+	for _, t := range rebuilt {
+		_, err = tx.Exec(fmt.Sprintf(`LOCK TABLE %s IN ACCESS EXCLUSIVE MODE`,
+			pq.QuoteIdentifier(t.Name)))
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		lastSequence, n, err := replayEvents(tx, table, sequence)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+
+		numProcessed += n
+		sequence = lastSequence
+	}
+
+	// Note the live tables' foreign keys and the names of their indexes
+	// before they're renamed out of the way. LIKE doesn't copy foreign keys,
+	// and it named the shadows' indexes after the shadows.
+	var keys []foreignKey
+	var renames [][2]string
+	for _, t := range rebuilt {
+		tableKeys, err := foreignKeys(tx, t.Name)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, tableKeys...)
+
+		tableRenames, err := indexRenames(tx, t.Name, t.Name+RebuildSuffix)
+		if err != nil {
+			return err
+		}
+		renames = append(renames, tableRenames...)
+	}
+
+	var queries []string
+	for _, t := range rebuilt {
+		queries = append(queries,
+			fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`,
+				pq.QuoteIdentifier(t.Name), pq.QuoteIdentifier(t.Name+"_old")),
+			fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`,
+				pq.QuoteIdentifier(t.Name+RebuildSuffix), pq.QuoteIdentifier(t.Name)))
+	}
+
+	// Drop children before their parent, whose old table their foreign keys
+	// still reference.
+	for i := len(rebuilt) - 1; i >= 0; i-- {
+		queries = append(queries, fmt.Sprintf(`DROP TABLE %s`,
+			pq.QuoteIdentifier(rebuilt[i].Name+"_old")))
+	}
+
+	for _, rename := range renames {
+		queries = append(queries, fmt.Sprintf(`ALTER INDEX %s RENAME TO %s`,
+			pq.QuoteIdentifier(rename[0]), pq.QuoteIdentifier(rename[1])))
+	}
+
+	// Definitions name the referenced table as it was when they were read,
+	// which is now the rebuilt table.
+	for _, key := range keys {
+		queries = append(queries, fmt.Sprintf(`ALTER TABLE %s ADD CONSTRAINT %s %s`,
+			pq.QuoteIdentifier(key.Table), pq.QuoteIdentifier(key.Name), key.Definition))
+	}
+
+	for _, query := range queries {
+		_, err = tx.Exec(query)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rebuilt %v from %v event(s) in %v.",
+		table.Name, numProcessed, time.Now().Sub(start))
+	return nil
+}
+
+// Replays a page of archived events with a sequence greater than the one
+// given into the shadow copies of a table and its children. Returns the
+// sequence of the last event replayed and the number of events in the page,
+// which is zero once the archive is exhausted.
+//
+// Events that are in the dead letter table never made it into the live table
+// either, so they're skipped. They're loaded by `retry-dead-letters` instead.
+func replayEvents(tx *sql.Tx, table *Table, sequence int64) (int64, int, error) {
+	rows, err := tx.Query(`
+		SELECT sequence, data
+		FROM events e
+		WHERE sequence > $1
+			AND NOT EXISTS (
+				SELECT 1 FROM dead_letter_events d WHERE d.sequence = e.sequence
+			)
+		ORDER BY sequence
+		LIMIT $2`,
+		sequence, RebuildPageSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Read the whole page before copying because pq can't start a COPY while
+	// a result set is still open on the same connection.
+	var events []Event
+	for rows.Next() {
+		var data []byte
+		var event Event
+		err = rows.Scan(&sequence, &data)
+		if err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+
+		err = json.Unmarshal(data, &event)
+		if err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+
+		event.Sequence = uint64(sequence)
+		events = append(events, event)
+	}
+	err = rows.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	if len(events) == 0 {
+		return sequence, 0, nil
+	}
+
+	// Unlike a normal load, a rebuild stops on the first event for the table
+	// that doesn't map so that a broken mapping never gets swapped in.
+	// Events for other tables don't matter here.
+	tableRows, deadLetters := mapEvents(events)
+	for _, deadLetter := range deadLetters {
+		if eventObjectType(deadLetter.Event) == table.Object {
+			return 0, 0, deadLetter.Err
+		}
+	}
+
+	_, err = upsertTableRows(tx, table, RebuildSuffix, tableRows[table], false)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return sequence, len(events), nil
+}
+
+// Pairs each index of a shadow table with the live table's matching index,
+// which is the one with the same definition apart from its name and table.
+// Returns pairs of the shadow's index name and the name that it should be
+// given.
+func indexRenames(tx *sql.Tx, table, shadow string) ([][2]string, error) {
+	rows, err := tx.Query(`
+		SELECT s.relname, l.relname
+		FROM pg_index si
+			JOIN pg_class s ON s.oid = si.indexrelid
+			JOIN pg_index li ON li.indrelid = $1::regclass
+			JOIN pg_class l ON l.oid = li.indexrelid
+		WHERE si.indrelid = $2::regclass
+			AND si.indisunique = li.indisunique
+			AND substring(pg_get_indexdef(si.indexrelid) FROM ' USING .*$')
+				= substring(pg_get_indexdef(li.indexrelid) FROM ' USING .*$')`,
+		pq.QuoteIdentifier(table), pq.QuoteIdentifier(shadow))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var renames [][2]string
+	for rows.Next() {
+		var rename [2]string
+		err = rows.Scan(&rename[0], &rename[1])
+		if err != nil {
+			return nil, err
+		}
+		renames = append(renames, rename)
+	}
+	return renames, rows.Err()
+}
+
+// foreignKey is a foreign key constraint as Postgres would print it.
+type foreignKey struct {
+	Table      string
+	Name       string
+	Definition string
+}
+
+// Returns the foreign keys of a table, like those of a child table on its
+// parent.
+func foreignKeys(tx *sql.Tx, table string) ([]foreignKey, error) {
+	rows, err := tx.Query(`
+		SELECT conname, pg_get_constraintdef(oid)
+		FROM pg_constraint
+		WHERE conrelid = $1::regclass AND contype = 'f'`,
+		pq.QuoteIdentifier(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []foreignKey
+	for rows.Next() {
+		key := foreignKey{Table: table}
+		err = rows.Scan(&key.Name, &key.Definition)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// Number of objects requested per page of a Stripe list API.
+	ReconcilePageSize = 100
+
+	// Number of warehouse rows read at a time while comparing.
+	ReconcileChunkSize = 1000
+)
+
+// The Stripe API that lists the objects of each table that can be
+// reconciled. Subscriptions are only listed when they're canceled if asked
+// for explicitly.
+var reconcilePaths = map[string]string{
+	"charges":       "/v1/charges",
+	"customers":     "/v1/customers",
+	"disputes":      "/v1/disputes",
+	"invoices":      "/v1/invoices",
+	"subscriptions": "/v1/subscriptions?status=all",
+}
+
+// Columns that aren't compared because they describe how a row was loaded
+// rather than the object itself.
+var reconcileIgnoredColumns = map[string]bool{
+	"account_id":    true,
+	"event_created": true,
+	"sequence":      true,
+}
+
+// listPage is a page of a Stripe list API with its objects left undecoded.
+type listPage struct {
+	Data    []json.RawMessage `json:"data"`
+	HasMore bool              `json:"has_more"`
+}
+
+// reconcileResult counts what a reconciliation found.
+type reconcileResult struct {
+	Listed    int
+	Matched   int
+	Missing   []Row
+	Extra     [][]interface{}
+	Divergent []Row
+
+	// Skipped is the number of the table's rows that weren't compared
+	// because their object was listed by the API but couldn't be mapped.
+	Skipped int
+}
+
+// Compares a typed table against the objects that the Stripe API currently
+// lists for it, and reports rows that are missing from the warehouse, extra
+// rows that the API no longer has, and rows whose fields have diverged. With
+// -repair, missing and divergent rows are written from the API's version and
+// extra rows are deleted.
+//
+// Objects that the API lists but that can't be redacted or mapped are
+// skipped, and their rows are left alone rather than being taken for extra
+// ones, which a repair would delete.
+func reconcile(db *sql.DB, conf Conf, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	account := flags.String("account", "", "Connected account to reconcile instead of the platform")
+	repair := flags.Bool("repair", false, "Write missing and divergent rows and delete extra ones")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: consumer reconcile [-account <account>] [-repair] <table>")
+	}
+
+	table := findTable(flags.Arg(0))
+	path, ok := reconcilePaths[flags.Arg(0)]
+	if table == nil || !ok {
+		return fmt.Errorf("Can't reconcile table: %v", flags.Arg(0))
+	}
+
+	start := time.Now()
+
+	result, err := compareTable(context.Background(), db, conf, table, path, *account)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Reconciled %v in %v: %v listed, %v matched, %v missing, %v extra, %v divergent, %v skipped.",
+		table.Name, time.Now().Sub(start), result.Listed, result.Matched,
+		len(result.Missing), len(result.Extra), len(result.Divergent), result.Skipped)
+
+	if !*repair {
+		return nil
+	}
+
+	return repairRows(db, conf, table, *account, result)
+}
+
+// Compares the table against the API a page at a time, so that only the rows
+// that differ are held in memory. Each page of objects is compared against
+// the table's rows with the same IDs, and the IDs are collected in a
+// temporary table. Once the listing is done, the table is read in chunks
+// ordered by ID for rows that weren't listed, which are extra.
+func compareTable(ctx context.Context, db *sql.DB, conf Conf, table *Table, path, account string) (*reconcileResult, error) {
+	// Temporary tables belong to a connection, so the comparison runs in a
+	// transaction that's rolled back once it's done.
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TEMP TABLE reconcile_listed (
+			id text PRIMARY KEY,
+			skipped boolean NOT NULL
+		) ON COMMIT DROP`)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &reconcileResult{}
+	err = listSourceRows(ctx, conf, table, path, account, func(rows []Row, skipped []string) error {
+		return comparePage(tx, table, account, rows, skipped, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = findExtraRows(tx, table, account, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Lists every object from a Stripe list API and maps each to a row for the
+// table, passing them to fn a page at a time along with the IDs of objects
+// that were skipped. Objects go through the same redaction, decoding, and
+// mapping as they would in an event so that they can be compared column for
+// column.
+//
+// The API's version of an object can't be placed among the feed's events, so
+// rows are stamped as if they came from an event at the object's creation
+// with sequence 0. That's older than any event that could be loaded for the
+// object, so the API's version never takes the place of one of those.
+func listSourceRows(ctx context.Context, conf Conf, table *Table, path, account string, fn func(rows []Row, skipped []string) error) error {
+	client := &http.Client{Timeout: conf.RequestTimeout}
+
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+
+	var startingAfter string
+	for {
+		url := fmt.Sprintf("%s%s%slimit=%v", conf.ReconcileURL, path, separator, ReconcilePageSize)
+		if startingAfter != "" {
+			url = fmt.Sprintf("%s&starting_after=%s", url, startingAfter)
+		}
+
+		data, err := requestWithRetries(ctx, client, conf, url, account)
+		if err != nil {
+			return err
+		}
+
+		var page listPage
+		err = json.Unmarshal(data, &page)
+		if err != nil {
+			return err
+		}
+
+		if len(page.Data) == 0 {
+			break
+		}
+
+		var events []Event
+		var skipped []string
+		for _, object := range page.Data {
+			var fields listedObject
+			json.Unmarshal(object, &fields)
+
+			event := Event{
+				Account:  account,
+				Created:  fields.Created,
+				Data:     EventData{Object: object},
+				Sequence: 0,
+				Type:     table.Object + ".reconciled",
+			}
+
+			// Redact like the load path does, or redacted columns would
+			// always look divergent.
+			err = redactEvent(&event)
+			if err != nil {
+				log.Printf("Skipping object that couldn't be redacted: %v", err)
+				skipped = append(skipped, fields.ID)
+				continue
+			}
+			events = append(events, event)
+		}
+
+		tableRows, deadLetters := mapEvents(events)
+		for _, deadLetter := range deadLetters {
+			log.Printf("Skipping object that couldn't be mapped: %v", deadLetter.Err)
+			skipped = append(skipped, objectID(deadLetter.Event.Data.Object))
+		}
+
+		err = fn(tableRows[table], skipped)
+		if err != nil {
+			return err
+		}
+
+		if !page.HasMore {
+			break
+		}
+
+		startingAfter = objectID(page.Data[len(page.Data)-1])
+		if startingAfter == "" {
+			return fmt.Errorf("Last object of page has no ID: %v", url)
+		}
+	}
+
+	return nil
+}
+
+// listedObject is the fields of an undecoded object from a list API that are
+// needed before it's mapped.
+type listedObject struct {
+	ID      string `json:"id"`
+	Created int64  `json:"created"`
+}
+
+// Returns the ID of an undecoded object, or an empty string if it doesn't
+// have one.
+func objectID(object json.RawMessage) string {
+	var fields listedObject
+	json.Unmarshal(object, &fields)
+	return fields.ID
+}
+
+// Compares a page of rows from the source against the table's rows with the
+// same IDs, and records the page's IDs as listed. An object that's already
+// been listed on an earlier page (because objects were created while
+// listing) isn't compared again.
+func comparePage(tx *sql.Tx, table *Table, account string, sourceRows []Row, skipped []string, result *reconcileResult) error {
+	idIndex := columnIndex(table, "id")
+
+	var ids []string
+	for _, row := range sourceRows {
+		ids = append(ids, row.Values[idIndex].(string))
+	}
+
+	listedIDs, err := queryIDs(tx, `
+		INSERT INTO reconcile_listed (id, skipped)
+		SELECT unnest($1::text[]), false
+		ON CONFLICT DO NOTHING
+		RETURNING id`,
+		pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, id := range listedIDs {
+		listed[id] = true
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO reconcile_listed (id, skipped)
+		SELECT unnest($1::text[]), true
+		ON CONFLICT DO NOTHING`,
+		pq.Array(skipped))
+	if err != nil {
+		return err
+	}
+
+	stored, err := readRows(tx, table, fmt.Sprintf(`
+		SELECT %s
+		FROM %s
+		WHERE account_id = $1 AND id = ANY($2)`,
+		strings.Join(table.ColumnNames(), ", "), table.Name),
+		account, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+
+	storedByID := make(map[string][]interface{})
+	for _, values := range stored {
+		storedByID[values[idIndex].(string)] = values
+	}
+
+	for _, row := range sourceRows {
+		id := row.Values[idIndex].(string)
+		if !listed[id] {
+			continue
+		}
+		result.Listed++
+
+		values, ok := storedByID[id]
+		if !ok {
+			log.Printf("Missing: %v", id)
+			result.Missing = append(result.Missing, row)
+			continue
+		}
+
+		differences := diffRow(table, row.Values, values)
+		if len(differences) > 0 {
+			log.Printf("Divergent: %v (%v)", id, strings.Join(differences, ", "))
+			result.Divergent = append(result.Divergent, row)
+		} else {
+			result.Matched++
+		}
+	}
+	return nil
+}
+
+// Reads the table's rows for the account that weren't listed, in chunks
+// ordered by ID, and counts the rows whose objects were skipped.
+func findExtraRows(tx *sql.Tx, table *Table, account string, result *reconcileResult) error {
+	idIndex := columnIndex(table, "id")
+
+	// IDs are ordered byte by byte regardless of the database's collation so
+	// that paging by the last ID is reliable. Each table has an index on
+	// `(account_id, id COLLATE "C")` so that this doesn't sort the whole
+	// table for every chunk.
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM %s t
+		WHERE account_id = $1 AND id COLLATE "C" > $2
+			AND NOT EXISTS (SELECT 1 FROM reconcile_listed l WHERE l.id = t.id)
+		ORDER BY id COLLATE "C"
+		LIMIT $3`,
+		strings.Join(table.ColumnNames(), ", "), table.Name)
+
+	var lastID string
+	for {
+		chunk, err := readRows(tx, table, query, account, lastID, ReconcileChunkSize)
+		if err != nil {
+			return err
+		}
+
+		for _, values := range chunk {
+			log.Printf("Extra: %v", values[idIndex])
+			result.Extra = append(result.Extra, values)
+		}
+
+		if len(chunk) < ReconcileChunkSize {
+			break
+		}
+		lastID = chunk[len(chunk)-1][idIndex].(string)
+	}
+
+	return tx.QueryRow(fmt.Sprintf(`
+		SELECT count(*)
+		FROM %s t
+		JOIN reconcile_listed l ON l.id = t.id
+		WHERE t.account_id = $1 AND l.skipped`,
+		table.Name), account).Scan(&result.Skipped)
+}
+
+// Reads the rows returned by a query selecting every column of the table.
+func readRows(tx *sql.Tx, table *Table, query string, args ...interface{}) ([][]interface{}, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values [][]interface{}
+	for rows.Next() {
+		row := make([]interface{}, len(table.Columns))
+		pointers := make([]interface{}, len(row))
+		for i := range row {
+			pointers[i] = &row[i]
+		}
+
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, row)
+	}
+	return values, rows.Err()
+}
+
+// Returns a description of every column that differs between a row mapped
+// from the source and one read from the table.
+func diffRow(table *Table, source, warehouse []interface{}) []string {
+	var differences []string
+	for i, column := range table.Columns {
+		if reconcileIgnoredColumns[column.Name] {
+			continue
+		}
+
+		sourceValue := comparableValue(column.Type, source[i])
+		warehouseValue := comparableValue(column.Type, warehouse[i])
+		if sourceValue != warehouseValue {
+			differences = append(differences, fmt.Sprintf("%v: %v in API, %v in warehouse",
+				column.Name, sourceValue, warehouseValue))
+		}
+	}
+	return differences
+}
+
+// Converts a value either mapped from an object or read back from Postgres to
+// a string that compares equal to the other if they represent the same value.
+func comparableValue(columnType ColumnType, value interface{}) string {
+	if value == nil {
+		return "NULL"
+	}
+
+	if b, ok := value.([]byte); ok {
+		value = string(b)
+	}
+
+	switch columnType {
+	case NumericColumn:
+		// Compare exactly so that "12.30" and "12.3" are equal.
+		if s, ok := value.(string); ok {
+			if r, ok := new(big.Rat).SetString(s); ok {
+				return r.RatString()
+			}
+		}
+
+	case TimestampColumn:
+		if t, ok := value.(time.Time); ok {
+			return t.UTC().Format(time.RFC3339)
+		}
+	}
+
+	return fmt.Sprint(value)
+}
+
+// Writes missing and divergent rows and deletes extra rows (along with their
+// child rows) in a single transaction.
+//
+// Rows from the API are stamped older than any event for their objects (see
+// listSourceRows), so what's stored for those objects is marked as older
+// still to let them replace it, and a deletion recorded for an object that
+// the API still lists is dropped. They're not versions from the feed, so
+// they're left out of history. Any event for the objects that's loaded later
+// replaces them in turn.
+//
+// Extra rows are deleted as if a deletion of their objects had been loaded
+// at the current checkpoint, so that the deletion is recorded and an older
+// event that's replayed can't bring them back.
+func repairRows(db *sql.DB, conf Conf, table *Table, account string, result *reconcileResult) error {
+	checkpoint, err := readCheckpoint(db)
+	if err != nil {
+		return err
+	}
+	var sequence uint64
+	if checkpoint != nil {
+		sequence = *checkpoint
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows := append(append([]Row(nil), result.Missing...), result.Divergent...)
+
+	var deletions []Row
+	now := time.Now().Unix()
+	for _, values := range result.Extra {
+		deletions = append(deletions, Row{
+			Event:   &Event{Account: account, Created: now, Sequence: sequence},
+			Values:  values,
+			Deleted: true,
+		})
+	}
+
+	var touched touchedDays
+	if conf.Aggregates {
+		touched = make(touchedDays)
+		err = touched.addStoredRows(tx, table, append(append([]Row(nil), rows...), deletions...))
+		if err != nil {
+			return err
+		}
+		touched.addRows(table, rows)
+	}
+
+	idIndex := columnIndex(table, "id")
+	var ids []string
+	for _, row := range rows {
+		ids = append(ids, row.Values[idIndex].(string))
+	}
+
+	if len(ids) > 0 {
+		_, err = tx.Exec(fmt.Sprintf(`
+			UPDATE %s SET event_created = NULL
+			WHERE account_id = $1 AND id = ANY($2)`,
+			table.Name), account, pq.Array(ids))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			DELETE FROM deletions
+			WHERE table_name = $1 AND account_id = $2 AND id = ANY($3)`,
+			table.Name, account, pq.Array(ids))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = upsertTableRows(tx, table, "", rows, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = upsertTableRows(tx, table, "", deletions, conf.History)
+	if err != nil {
+		return err
+	}
+
+	if conf.Aggregates {
+		err = refreshAggregates(tx, touched)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Repaired %v: wrote %v row(s) and deleted %v.", table.Name, len(rows), len(deletions))
+	return nil
+}
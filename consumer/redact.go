@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/brandur/stripe-warehouse/redact"
+)
+
+// The policy that redacts personal information from event objects before
+// they're loaded, or nil if nothing is redacted. Set at startup before any
+// events are mapped.
+var redactPolicy *redact.Policy
+
+// Redacts an event's object and previous attributes according to the policy,
+// and rewrites its raw form to match so that what's archived or dead lettered
+// doesn't contain anything that the typed tables don't.
+func redactEvent(event *Event) error {
+	if redactPolicy == nil {
+		return nil
+	}
+
+	object, err := redactObject(event.Data.Object)
+	if err != nil {
+		return err
+	}
+	event.Data.Object = object
+
+	previousAttributes, err := redactObject(event.Data.PreviousAttributes)
+	if err != nil {
+		return err
+	}
+	event.Data.PreviousAttributes = previousAttributes
+
+	// Events made up from API objects by reconcile have no raw form.
+	if event.Raw == nil {
+		return nil
+	}
+
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(event.Raw, &raw)
+	if err != nil {
+		return err
+	}
+
+	var data map[string]json.RawMessage
+	err = json.Unmarshal(raw["data"], &data)
+	if err != nil {
+		return err
+	}
+
+	data["object"] = object
+	if previousAttributes != nil {
+		data["previous_attributes"] = previousAttributes
+	}
+
+	raw["data"], err = json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	event.Raw, err = json.Marshal(raw)
+	return err
+}
+
+// Applies the policy to an encoded object. Numbers are decoded as
+// json.Number so that large integers come back out unchanged.
+func redactObject(data json.RawMessage) (json.RawMessage, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	var object map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&object)
+	if err != nil {
+		return nil, err
+	}
+
+	// An object of null has nothing to redact.
+	if object == nil {
+		return data, nil
+	}
+
+	redactPolicy.Apply(object)
+	return json.Marshal(object)
+}
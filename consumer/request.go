@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Bounds on how long to wait between retries. The wait doubles after
+	// every attempt starting from the minimum.
+	RetryMinBackoff = 500 * time.Millisecond
+	RetryMaxBackoff = 30 * time.Second
+
+	// Maximum number of bytes of a response body to include in an error.
+	ErrorBodyLimit = 512
+)
+
+// Source of randomness for backoff jitter. Seeded so that separate processes
+// don't pick the same waits. Only used by the fetching goroutine.
+var jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// StatusError is returned for a response from the server that wasn't
+// successful.
+type StatusError struct {
+	StatusCode int
+	Body       string
+
+	// RetryAfter is how long the server asked us to wait before trying
+	// again, or zero if it didn't say.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Non-200 response from server (status %v): %v",
+		e.StatusCode, e.Body)
+}
+
+// Retriable returns whether the request that produced the error might succeed
+// if it's tried again. Rate limiting and server errors are usually
+// transient, but something like bad credentials (401) or a bad request (400)
+// will fail the same way every time.
+func (e *StatusError) Retriable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// Makes a GET request to url, retrying with exponential backoff and jitter on
+// network errors and retriable statuses. Returns the body of the first
+// successful response. If account is set, the request is made on behalf of
+// that connected account.
+func requestWithRetries(ctx context.Context, client *http.Client, conf Conf, url, account string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		data, err := request(ctx, client, conf.StripeKey, url, account)
+		if err == nil {
+			return data, nil
+		}
+
+		// If we're shutting down, the failure was probably because the
+		// request was cancelled, so there's no point in retrying.
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		wait := backoff(attempt)
+		if statusErr, ok := err.(*StatusError); ok {
+			if !statusErr.Retriable() {
+				return nil, err
+			}
+
+			if statusErr.RetryAfter > 0 {
+				wait = statusErr.RetryAfter
+			}
+		}
+
+		if attempt >= conf.RequestMaxRetries {
+			return nil, fmt.Errorf("Giving up after %v attempt(s): %v", attempt+1, err)
+		}
+
+		log.Printf("Request failed (attempt %v): %v. Retrying in %v.",
+			attempt+1, err, wait)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func request(ctx context.Context, client *http.Client, stripeKey, url, account string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(stripeKey, "")
+	if account != "" {
+		req.Header.Set("Stripe-Account", account)
+	}
+
+	// Note that Go will automatically request gzip compression because we
+	// didn't explicitly add an `Accept-Encoding` header. The "endpoint"
+	// program supports this, so it's a good thing.
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body := string(data)
+		if len(body) > ErrorBodyLimit {
+			body = body[:ErrorBodyLimit] + "..."
+		}
+
+		return nil, &StatusError{
+			StatusCode: resp.StatusCode,
+			Body:       body,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	return data, nil
+}
+
+// Returns how long to wait before the given retry attempt. The wait is
+// randomized over the whole backoff interval ("full jitter") so that many
+// clients failing at once don't all retry in lockstep.
+func backoff(attempt int) time.Duration {
+	max := RetryMaxBackoff
+	if attempt < 16 {
+		if d := RetryMinBackoff << uint(attempt); d < max {
+			max = d
+		}
+	}
+	return time.Duration(jitter.Int63n(int64(max)))
+}
+
+// Parses a `Retry-After` header, which may be either a number of seconds or
+// an HTTP date. Returns zero if the header is empty or malformed.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		if wait := t.Sub(time.Now()); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
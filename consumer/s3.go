@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"time"
+
+	"github.com/minio/minio-go"
+)
+
+const (
+	// Name of the object under the prefix that records the last sequence
+	// durably uploaded.
+	S3CheckpointName = "_checkpoint.json"
+
+	// Smallest part that S3 accepts in a multipart upload (other than the
+	// last one).
+	S3MinPartSize = 5 * 1024 * 1024
+)
+
+// s3Checkpoint is the contents of the checkpoint object.
+type s3Checkpoint struct {
+	Sequence  uint64    `json:"sequence"`
+	Key       string    `json:"key"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// s3Sink archives the raw event feed to an S3-compatible bucket. Events from
+// committed batches are accumulated into a gzip-compressed newline-delimited
+// JSON object until it reaches a target size, at which point it's uploaded
+// under a key made up of the range of sequences that it contains:
+//
+//	events/00000000000000000000-00000000000000009999.ndjson.gz
+//
+// Objects larger than a part are uploaded with a multipart upload. Once an
+// object is uploaded, a checkpoint object is written with its last sequence,
+// so events that were buffered but not yet uploaded when the consumer stopped
+// are read again on the next run.
+type s3Sink struct {
+	client     *minio.Core
+	bucket     string
+	prefix     string
+	objectSize int
+	partSize   int
+
+	buffer        bytes.Buffer
+	gzipWriter    *gzip.Writer
+	numBuffered   int
+	firstSequence uint64
+	lastSequence  uint64
+}
+
+func newS3Sink(conf Conf) (*s3Sink, error) {
+	if conf.S3Bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET is required to load into S3")
+	}
+	if conf.S3PartSize < S3MinPartSize {
+		return nil, fmt.Errorf("S3_PART_SIZE must be at least %v bytes", S3MinPartSize)
+	}
+
+	client, err := minio.NewCore(conf.S3Endpoint, conf.S3AccessKeyID,
+		conf.S3SecretAccessKey, conf.S3Secure)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &s3Sink{
+		client:     client,
+		bucket:     conf.S3Bucket,
+		prefix:     conf.S3Prefix,
+		objectSize: conf.S3ObjectSize,
+		partSize:   conf.S3PartSize,
+	}
+	sink.gzipWriter = gzip.NewWriter(&sink.buffer)
+	return sink, nil
+}
+
+func (s *s3Sink) Begin() (Batch, error) {
+	return &s3Batch{sink: s}, nil
+}
+
+func (s *s3Sink) Checkpoint() (*uint64, error) {
+	object, _, err := s.client.GetObject(s.bucket, s.key(S3CheckpointName),
+		minio.GetObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer object.Close()
+
+	data, err := ioutil.ReadAll(object)
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoint s3Checkpoint
+	err = json.Unmarshal(data, &checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint.Sequence, nil
+}
+
+// Close uploads anything still buffered so that a clean shutdown doesn't
+// leave events to be read again.
+func (s *s3Sink) Close() error {
+	return s.flush()
+}
+
+// Appends committed events to the buffered object, uploading it once it's
+// reached its target size.
+func (s *s3Sink) append(events []Event) error {
+	for _, event := range events {
+		if s.numBuffered == 0 {
+			s.firstSequence = event.Sequence
+		}
+
+		_, err := s.gzipWriter.Write(event.Raw)
+		if err != nil {
+			return err
+		}
+		_, err = s.gzipWriter.Write([]byte("\n"))
+		if err != nil {
+			return err
+		}
+
+		s.numBuffered++
+		s.lastSequence = event.Sequence
+	}
+
+	if s.buffer.Len() >= s.objectSize {
+		return s.flush()
+	}
+	return nil
+}
+
+// Uploads the buffered object and then moves the checkpoint past it.
+//
+// The gzip writer has to be closed to finish the object, so if the upload
+// fails, a new gzip member is started after the finished one rather than
+// discarding what's buffered. Readers treat concatenated members as a single
+// stream, so the events are uploaded along with any later ones on the next
+// try.
+func (s *s3Sink) flush() error {
+	if s.numBuffered == 0 {
+		return nil
+	}
+
+	err := s.gzipWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	err = s.upload()
+	if err != nil {
+		s.gzipWriter.Reset(&s.buffer)
+		return err
+	}
+
+	s.buffer.Reset()
+	s.gzipWriter.Reset(&s.buffer)
+	s.numBuffered = 0
+	return nil
+}
+
+// Uploads the finished object in the buffer and writes a checkpoint for it.
+func (s *s3Sink) upload() error {
+	var err error
+
+	start := time.Now()
+	key := s.key(fmt.Sprintf("%020d-%020d.ndjson.gz", s.firstSequence, s.lastSequence))
+	data := s.buffer.Bytes()
+
+	if len(data) > s.partSize {
+		err = s.uploadMultipart(key, data)
+	} else {
+		_, err = s.client.PutObject(s.bucket, key, bytes.NewReader(data),
+			int64(len(data)), "", "",
+			map[string]string{"Content-Type": "application/gzip"}, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	checkpoint, err := json.Marshal(&s3Checkpoint{
+		Sequence:  s.lastSequence,
+		Key:       key,
+		UpdatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(s.bucket, s.key(S3CheckpointName),
+		bytes.NewReader(checkpoint), int64(len(checkpoint)), "", "",
+		map[string]string{"Content-Type": "application/json"}, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Uploaded %v (%v event(s), %v byte(s)) in %v.",
+		key, s.numBuffered, len(data), time.Now().Sub(start))
+	return nil
+}
+
+// Uploads an object in parts, aborting the upload if any part fails so that
+// it doesn't linger in the bucket.
+func (s *s3Sink) uploadMultipart(key string, data []byte) error {
+	uploadID, err := s.client.NewMultipartUpload(s.bucket, key,
+		minio.PutObjectOptions{ContentType: "application/gzip"})
+	if err != nil {
+		return err
+	}
+
+	var parts []minio.CompletePart
+	for offset, partID := 0, 1; offset < len(data); offset, partID = offset+s.partSize, partID+1 {
+		end := offset + s.partSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		part, err := s.client.PutObjectPart(s.bucket, key, uploadID, partID,
+			bytes.NewReader(data[offset:end]), int64(end-offset), "", "", nil)
+		if err != nil {
+			s.client.AbortMultipartUpload(s.bucket, key, uploadID)
+			return err
+		}
+
+		parts = append(parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+
+	_, err = s.client.CompleteMultipartUpload(s.bucket, key, uploadID, parts)
+	if err != nil {
+		s.client.AbortMultipartUpload(s.bucket, key, uploadID)
+		return err
+	}
+	return nil
+}
+
+func (s *s3Sink) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+// s3Batch holds a page's events until it's committed. Only the raw event feed
+// is archived to S3, so typed rows and dead letters (whose events are in the
+// archive anyway) are ignored.
+type s3Batch struct {
+	sink   *s3Sink
+	events []Event
+}
+
+func (b *s3Batch) ArchiveEvents(events []Event) error {
+	b.events = append(b.events, events...)
+	return nil
+}
+
+func (b *s3Batch) WriteRows(table *Table, rows []Row) (int, error) {
+	return 0, nil
+}
+
+func (b *s3Batch) WriteDeadLetters(deadLetters []DeadLetter) error {
+	return nil
+}
+
+func (b *s3Batch) Commit(sequence uint64) error {
+	err := b.sink.append(b.events)
+	b.events = nil
+	return err
+}
+
+func (b *s3Batch) Rollback() error {
+	b.events = nil
+	return nil
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory stand-in for the parts of the S3 API that the sink
+// uses, served over HTTP so that it's exercised through the real client.
+// Objects are stored by key regardless of their bucket.
+type fakeS3 struct {
+	mu         sync.Mutex
+	objects    map[string][]byte
+	uploads    map[string]map[int][]byte
+	numUploads int
+	completed  int
+
+	// The number of object uploads still to be refused.
+	failPuts int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := path[0]
+	var key string
+	if len(path) > 1 {
+		key = path[1]
+	}
+	query := r.URL.Query()
+
+	body, err := readS3Body(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && query["location"] != nil:
+		writeS3XML(w, 200, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+		}{})
+
+	case r.Method == "GET":
+		data, ok := f.objects[key]
+		if !ok {
+			writeS3XML(w, 404, struct {
+				XMLName xml.Name `xml:"Error"`
+				Code    string
+				Message string
+			}{Code: "NoSuchKey", Message: "The specified key does not exist."})
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Write(data)
+
+	case r.Method == "POST" && query["uploads"] != nil:
+		f.numUploads++
+		uploadID := fmt.Sprintf("upload-%v", f.numUploads)
+		f.uploads[uploadID] = make(map[int][]byte)
+		writeS3XML(w, 200, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadID string `xml:"UploadId"`
+		}{Bucket: bucket, Key: key, UploadID: uploadID})
+
+	case r.Method == "PUT" && query.Get("uploadId") != "":
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			http.Error(w, "No such upload", 404)
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[partNumber] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%v"`, partNumber))
+
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			http.Error(w, "No such upload", 404)
+			return
+		}
+
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+			} `xml:"Part"`
+		}
+		err = xml.Unmarshal(body, &complete)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		var data []byte
+		for _, part := range complete.Parts {
+			data = append(data, parts[part.PartNumber]...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, query.Get("uploadId"))
+		f.completed++
+
+		writeS3XML(w, 200, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"etag"`})
+
+	case r.Method == "DELETE" && query.Get("uploadId") != "":
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(204)
+
+	case r.Method == "PUT" && f.failPuts > 0:
+		f.failPuts--
+		writeS3XML(w, 403, struct {
+			XMLName xml.Name `xml:"Error"`
+			Code    string
+			Message string
+		}{Code: "AccessDenied", Message: "Access Denied"})
+
+	case r.Method == "PUT":
+		f.objects[key] = body
+		w.Header().Set("ETag", `"etag"`)
+
+	default:
+		http.Error(w, "Unsupported request", 400)
+	}
+}
+
+// Returns the names of stored objects, sorted.
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) object(key string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[key]
+}
+
+// Reads a request's body, decoding it if it was sent with a streaming
+// signature, which the client uses for uploads over plain HTTP.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	var data []byte
+	reader := bufio.NewReader(r.Body)
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(header), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		chunk := make([]byte, size+2)
+		_, err = io.ReadFull(reader, chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			return data, nil
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func writeS3XML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(v)
+}
+
+// Returns a sink writing to a fake S3 that uploads an object as soon as any
+// events are committed.
+func newTestS3Sink(t *testing.T, server *httptest.Server) *s3Sink {
+	sink, err := newS3Sink(Conf{
+		S3AccessKeyID:     "access",
+		S3Bucket:          "warehouse",
+		S3Endpoint:        strings.TrimPrefix(server.URL, "http://"),
+		S3ObjectSize:      1,
+		S3PartSize:        S3MinPartSize,
+		S3Prefix:          "events",
+		S3SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func testS3Events(first, last uint64) []Event {
+	var events []Event
+	for sequence := first; sequence <= last; sequence++ {
+		events = append(events, Event{
+			Raw:      json.RawMessage(fmt.Sprintf(`{"id":"evt_%v","sequence":%v}`, sequence, sequence)),
+			Sequence: sequence,
+		})
+	}
+	return events
+}
+
+func commitS3Events(t *testing.T, sink *s3Sink, events []Event) {
+	batch, err := sink.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = batch.ArchiveEvents(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = batch.Commit(events[len(events)-1].Sequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Decompresses an uploaded object and returns its lines.
+func readS3Lines(t *testing.T, data []byte) []string {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+}
+
+func readS3Checkpoint(t *testing.T, fake *fakeS3) s3Checkpoint {
+	var checkpoint s3Checkpoint
+	err := json.Unmarshal(fake.object("events/"+S3CheckpointName), &checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checkpoint
+}
+
+func TestS3SinkUpload(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	sink := newTestS3Sink(t, server)
+	events := testS3Events(1, 3)
+	commitS3Events(t, sink, events)
+
+	key := "events/00000000000000000001-00000000000000000003.ndjson.gz"
+	keys := fake.keys()
+	if len(keys) != 2 || keys[0] != key || keys[1] != "events/"+S3CheckpointName {
+		t.Fatalf("Unexpected objects: %v", keys)
+	}
+
+	lines := readS3Lines(t, fake.object(key))
+	if len(lines) != len(events) {
+		t.Fatalf("Expected %v line(s), got %v", len(events), len(lines))
+	}
+	for i, line := range lines {
+		if line != string(events[i].Raw) {
+			t.Errorf("Line %v: expected %s, got %s", i, events[i].Raw, line)
+		}
+	}
+
+	checkpoint := readS3Checkpoint(t, fake)
+	if checkpoint.Sequence != 3 || checkpoint.Key != key {
+		t.Errorf("Unexpected checkpoint: %+v", checkpoint)
+	}
+}
+
+func TestS3SinkUploadMultipart(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	sink := newTestS3Sink(t, server)
+	sink.partSize = 64
+	events := testS3Events(1, 50)
+	commitS3Events(t, sink, events)
+
+	fake.mu.Lock()
+	completed, inProgress := fake.completed, len(fake.uploads)
+	fake.mu.Unlock()
+	if completed != 1 {
+		t.Fatalf("Expected 1 multipart upload, got %v", completed)
+	}
+	if inProgress != 0 {
+		t.Errorf("Expected no uploads in progress, got %v", inProgress)
+	}
+
+	lines := readS3Lines(t, fake.object("events/00000000000000000001-00000000000000000050.ndjson.gz"))
+	if len(lines) != len(events) || lines[49] != string(events[49].Raw) {
+		t.Errorf("Unexpected object contents: %v", lines)
+	}
+}
+
+func TestS3SinkCheckpoint(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	sink := newTestS3Sink(t, server)
+
+	checkpoint, err := sink.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint != nil {
+		t.Fatalf("Expected no checkpoint, got %v", *checkpoint)
+	}
+
+	commitS3Events(t, sink, testS3Events(1, 3))
+
+	// Events buffered but not yet uploaded aren't checkpointed, so a new
+	// sink resumes after the last upload and reads them again.
+	sink.objectSize = 1024 * 1024
+	commitS3Events(t, sink, testS3Events(4, 5))
+
+	resumed := newTestS3Sink(t, server)
+	checkpoint, err = resumed.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint == nil || *checkpoint != 3 {
+		t.Fatalf("Expected checkpoint 3, got %v", checkpoint)
+	}
+
+	commitS3Events(t, resumed, testS3Events(4, 5))
+	if readS3Checkpoint(t, fake).Sequence != 5 {
+		t.Errorf("Unexpected checkpoint: %+v", readS3Checkpoint(t, fake))
+	}
+	if fake.object("events/00000000000000000004-00000000000000000005.ndjson.gz") == nil {
+		t.Errorf("Resumed events weren't uploaded: %v", fake.keys())
+	}
+}
+
+func TestS3SinkUploadRetried(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	sink := newTestS3Sink(t, server)
+
+	fake.mu.Lock()
+	fake.failPuts = 1
+	fake.mu.Unlock()
+
+	batch, err := sink.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = batch.ArchiveEvents(testS3Events(1, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = batch.Commit(3)
+	if err == nil {
+		t.Fatal("Expected the upload to fail")
+	}
+	if keys := fake.keys(); len(keys) != 0 {
+		t.Fatalf("Unexpected objects: %v", keys)
+	}
+
+	// The events that failed to upload go out with the next ones.
+	events := testS3Events(1, 5)
+	commitS3Events(t, sink, events[3:])
+
+	lines := readS3Lines(t, fake.object("events/00000000000000000001-00000000000000000005.ndjson.gz"))
+	if len(lines) != len(events) {
+		t.Fatalf("Expected %v line(s), got %v", len(events), lines)
+	}
+	for i, line := range lines {
+		if line != string(events[i].Raw) {
+			t.Errorf("Line %v: expected %s, got %s", i, events[i].Raw, line)
+		}
+	}
+	if readS3Checkpoint(t, fake).Sequence != 5 {
+		t.Errorf("Unexpected checkpoint: %+v", readS3Checkpoint(t, fake))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Sink is a destination that events are loaded into.
+type Sink interface {
+	// Begin starts a new batch. Nothing written to the batch is visible until
+	// it's committed.
+	Begin() (Batch, error)
+
+	// Checkpoint returns the sequence of the last event committed to the
+	// sink, or nil if nothing has been committed yet.
+	Checkpoint() (*uint64, error)
+
+	Close() error
+}
+
+// Batch is a set of writes that are committed to a sink atomically along with
+// a checkpoint.
+type Batch interface {
+	// ArchiveEvents writes events verbatim to the sink's raw event archive.
+	ArchiveEvents(events []Event) error
+
+	// WriteRows writes rows to one of the typed tables, replacing any
+	// existing rows with the same key. Rows are in the order of the events
+	// that they came from so that the last row for a key wins. The rows of
+	// the table's child tables are replaced along with their parent.
+	//
+	// Rows marked Deleted remove their object instead, and sinks that can
+	// record the deletion do. A row that's older than the one already stored
+	// for its object (by event created time and then sequence), or that
+	// wasn't created after the object's recorded deletion, is stale and is
+	// discarded instead. Returns the number of stale rows.
+	WriteRows(table *Table, rows []Row) (int, error)
+
+	// WriteDeadLetters records events that couldn't be loaded.
+	WriteDeadLetters(deadLetters []DeadLetter) error
+
+	// Commit makes the batch durable and records sequence as the sink's new
+	// checkpoint.
+	Commit(sequence uint64) error
+
+	// Rollback discards the batch. It's safe to call after Commit, in which
+	// case it does nothing.
+	Rollback() error
+}
+
+func newSink(conf Conf) (Sink, error) {
+	if conf.Aggregates && conf.Sink != "postgres" {
+		return nil, fmt.Errorf("AGGREGATES is only supported when loading into Postgres")
+	}
+
+	switch conf.Sink {
+	case "postgres":
+		if conf.DatabaseURL == "" {
+			return nil, fmt.Errorf("DATABASE_URL is required to load into Postgres")
+		}
+		if conf.Aggregates && !conf.History {
+			return nil, fmt.Errorf("AGGREGATES requires HISTORY because MRR is derived from subscription history")
+		}
+		return newPostgresSink(conf.DatabaseURL, conf.MigrationsDir, conf.History, conf.Aggregates)
+
+	case "parquet":
+		return newParquetSink(conf.ParquetDir, conf.ParquetFileSize)
+
+	case "s3":
+		return newS3Sink(conf)
+
+	case "sqlite":
+		return newSQLiteSink(conf.SQLitePath, conf.History)
+	}
+
+	return nil, fmt.Errorf("Unknown sink: %v", conf.Sink)
+}
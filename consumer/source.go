@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/brandur/stripe-warehouse/envelope"
+)
+
+const (
+	// Maximum number of events in a page read directly from Kafka. Matches
+	// the endpoint's default limit.
+	KafkaPageSize = 10000
+
+	// Number of seconds to wait for a message before assuming that we've
+	// reached the end of the topic. This is only a fallback in case the
+	// high water mark that we're reading to is never reached (because the
+	// topic was compacted out from under us for example).
+	KafkaConsumeTimeout = 3
+)
+
+// Source is a feed of events to load.
+//
+// Sequences mean the same thing for every source (the event's offset in the
+// Kafka topic), so a checkpoint written while loading from one source can be
+// resumed from another.
+type Source interface {
+	// Stream sends pages of the events that follow sequence, or of all events
+	// if sequence is nil, to out in order until the end of the feed is
+	// reached or ctx is cancelled.
+	Stream(ctx context.Context, sequence *uint64, out chan<- fetchedPage) error
+}
+
+func newSource(conf Conf) (Source, error) {
+	switch conf.Source {
+	case "http":
+		if conf.StripeKey == "" {
+			return nil, fmt.Errorf("STRIPE_KEY is required to load from the endpoint")
+		}
+		return &httpSource{conf: conf}, nil
+
+	case "kafka":
+		if conf.KafkaTopic == "" {
+			return nil, fmt.Errorf("KAFKA_TOPIC is required to load from Kafka")
+		}
+		return &kafkaSource{
+			brokers: strings.Split(conf.SeedBroker, ","),
+			topic:   conf.KafkaTopic,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown source: %v", conf.Source)
+}
+
+// httpSource pages through the event endpoint.
+type httpSource struct {
+	conf Conf
+}
+
+func (s *httpSource) Stream(ctx context.Context, sequence *uint64, out chan<- fetchedPage) error {
+	return requestEvents(ctx, s.conf, sequence, out)
+}
+
+// kafkaSource reads events directly out of the topic that the endpoint would
+// otherwise serve them from.
+type kafkaSource struct {
+	brokers []string
+	topic   string
+}
+
+func (s *kafkaSource) Stream(ctx context.Context, sequence *uint64, out chan<- fetchedPage) error {
+	// Headers are only returned by Kafka 0.11 and later.
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_11_0_0
+
+	client, err := sarama.NewClient(s.brokers, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Like the endpoint, read only the first partition.
+	var offset int64
+	if sequence != nil {
+		offset = int64(*sequence) + 1
+	} else {
+		offset, err = client.GetOffset(s.topic, 0, sarama.OffsetOldest)
+		if err != nil {
+			return err
+		}
+	}
+
+	// We read up to the end of the topic as it stands right now. Anything
+	// produced after this will be picked up by the next run.
+	highWaterMark, err := client.GetOffset(s.topic, 0, sarama.OffsetNewest)
+	if err != nil {
+		return err
+	}
+	if offset >= highWaterMark {
+		log.Printf("Already at end of topic.")
+		return nil
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	partitionConsumer, err := consumer.ConsumePartition(s.topic, 0, offset)
+	if err != nil {
+		return err
+	}
+	defer partitionConsumer.Close()
+
+	for index := 0; ; index++ {
+		startPage := time.Now()
+
+		var page Page
+		done := false
+
+	ConsumerLoop:
+		for len(page.Data) < KafkaPageSize {
+			select {
+			case message := <-partitionConsumer.Messages():
+				if !envelope.IsErasure(message) {
+					event, err := messageToEvent(message)
+					if err != nil {
+						return err
+					}
+					page.Data = append(page.Data, event)
+				}
+
+				if message.Offset+1 >= highWaterMark {
+					done = true
+					break ConsumerLoop
+				}
+
+			case err := <-partitionConsumer.Errors():
+				return err
+
+			case <-time.After(time.Second * time.Duration(KafkaConsumeTimeout)):
+				log.Printf("Timeout. Probably at end of topic.")
+				done = true
+				break ConsumerLoop
+
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		page.HasMore = !done
+
+		log.Printf("Read page of %v event(s) from Kafka in %v. Work queue depth is %v",
+			len(page.Data), time.Now().Sub(startPage), len(out))
+
+		select {
+		case out <- fetchedPage{index: index, page: page}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if done {
+			return nil
+		}
+	}
+}
+
+// Converts a Kafka message to an event in exactly the form that the endpoint
+// would have served it, so that the raw events archived are the same no
+// matter which source they came from.
+func messageToEvent(message *sarama.ConsumerMessage) (Event, error) {
+	var fields map[string]interface{}
+	if message.Value == nil {
+		fields = envelope.TombstoneFields(message)
+	} else {
+		// Keep numbers as json.Number so that they're re-encoded exactly.
+		decoder := json.NewDecoder(bytes.NewReader(message.Value))
+		decoder.UseNumber()
+		err := decoder.Decode(&fields)
+		if err != nil {
+			return Event{}, err
+		}
+	}
+
+	fields["sequence"] = message.Offset
+
+	// Same as the endpoint, fill the account from its header if the event
+	// doesn't carry it.
+	if _, ok := fields[envelope.AccountHeader]; !ok {
+		if account := envelope.Header(message, envelope.AccountHeader); account != "" {
+			fields[envelope.AccountHeader] = account
+		}
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return Event{}, err
+	}
+
+	var event Event
+	err = json.Unmarshal(data, &event)
+	return event, err
+}
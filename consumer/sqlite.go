@@ -0,0 +1,605 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Schema for the SQLite sink's bookkeeping tables. These mirror their
+// counterparts in db/migrations, minus features that SQLite doesn't have
+// like partitioning and jsonb.
+var sqliteStructure = []string{
+	`CREATE TABLE IF NOT EXISTS checkpoints (
+		name TEXT PRIMARY KEY,
+		sequence INTEGER NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS events (
+		sequence INTEGER PRIMARY KEY,
+		id TEXT,
+		type TEXT,
+		created TIMESTAMP NOT NULL,
+		data TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS dead_letter_events (
+		sequence INTEGER PRIMARY KEY,
+		id TEXT,
+		type TEXT,
+		error TEXT NOT NULL,
+		data TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 1,
+		failed_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS deletions (
+		table_name TEXT NOT NULL,
+		account_id TEXT NOT NULL,
+		id TEXT NOT NULL,
+		event_created TIMESTAMP NOT NULL,
+		sequence INTEGER NOT NULL,
+		PRIMARY KEY (table_name, account_id, id)
+	)`,
+}
+
+// sqliteSink loads into a local SQLite database. Unlike with Postgres, its
+// schema is created automatically from the table definitions so that a new
+// database can be used without any setup, and a database created by an older
+// version has its typed tables migrated to the current definitions.
+type sqliteSink struct {
+	db      *sql.DB
+	history bool
+}
+
+func newSQLiteSink(path string, history bool) (*sqliteSink, error) {
+	// SQLite only enforces foreign keys when asked to.
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+
+	db, err := sql.Open("sqlite3", path+separator+"_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows only one writer at a time anyway, and keeping to a
+	// single connection means that there's no lock contention between our
+	// own connections.
+	db.SetMaxOpenConns(1)
+
+	for _, statement := range sqliteStructure {
+		_, err = db.Exec(statement)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	var typedTables []sqliteTable
+	for _, table := range tables {
+		typedTables = append(typedTables, sqliteTable{table.Name, table.Columns, table.Key, nil})
+
+		// History isn't kept for child tables. Their rows are replaced
+		// along with a parent, so its history covers them.
+		if history {
+			typedTables = append(typedTables, sqliteTable{table.HistoryName(),
+				append(append([]Column(nil), table.Columns...), historyColumns...),
+				append(append([]string(nil), table.Key...), "valid_from_sequence"), nil})
+		}
+
+		for _, child := range table.Children {
+			typedTables = append(typedTables, sqliteTable{child.Name, child.Columns, child.Key,
+				[]string{fmt.Sprintf("FOREIGN KEY (%s) REFERENCES %s (%s) ON DELETE CASCADE",
+					strings.Join(child.ParentKey, ", "), table.Name, strings.Join(table.Key, ", "))}})
+		}
+	}
+
+	// Tables are rebuilt with foreign keys off, or dropping an old table
+	// would delete the rows of any table that references it.
+	_, err = db.Exec(`PRAGMA foreign_keys = OFF`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, table := range typedTables {
+		err = table.createOrMigrate(db)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Couldn't migrate %v: %v", table.Name, err)
+		}
+	}
+
+	_, err = db.Exec(`PRAGMA foreign_keys = ON`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteSink{db: db, history: history}, nil
+}
+
+// sqliteTable is the definition of a typed table, its history, or a child
+// table in a SQLite database.
+type sqliteTable struct {
+	Name        string
+	Columns     []Column
+	Key         []string
+	Constraints []string
+}
+
+// Creates the table if it doesn't exist, or migrates one created by an older
+// version. Missing columns are added, except that if the primary key has
+// changed (as it did when account_id was added) or a constraint is missing,
+// the table is rebuilt and its rows copied over. Key columns missing from
+// the old table are filled with an empty string like in Postgres.
+func (t sqliteTable) createOrMigrate(db *sql.DB) error {
+	_, err := db.Exec(sqliteCreateTable(t.Name, t.Columns, t.Key, t.Constraints...))
+	if err != nil {
+		return err
+	}
+
+	existing, key, err := sqliteTableInfo(db, t.Name)
+	if err != nil {
+		return err
+	}
+
+	var numForeignKeys int
+	err = db.QueryRow(fmt.Sprintf(`SELECT count(*) FROM pragma_foreign_key_list('%s')`, t.Name)).
+		Scan(&numForeignKeys)
+	if err != nil {
+		return err
+	}
+
+	if strings.Join(key, ", ") != strings.Join(t.Key, ", ") || numForeignKeys < len(t.Constraints) {
+		return t.rebuild(db, existing)
+	}
+
+	for _, column := range t.Columns {
+		if existing[column.Name] {
+			continue
+		}
+
+		_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`,
+			t.Name, column.Name, sqliteColumnType(column.Type)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recreates the table under a temporary name, copies the old table's rows
+// into it, and then swaps it in.
+func (t sqliteTable) rebuild(db *sql.DB, existing map[string]bool) error {
+	isKey := make(map[string]bool)
+	for _, name := range t.Key {
+		isKey[name] = true
+	}
+
+	var names, values []string
+	for _, column := range t.Columns {
+		switch {
+		case existing[column.Name]:
+			values = append(values, column.Name)
+		case isKey[column.Name]:
+			values = append(values, "''")
+		default:
+			continue
+		}
+		names = append(names, column.Name)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	migrated := t.Name + "_migrated"
+	statements := []string{
+		sqliteCreateTable(migrated, t.Columns, t.Key, t.Constraints...),
+		fmt.Sprintf(`INSERT INTO %s (%s) SELECT %s FROM %s`,
+			migrated, strings.Join(names, ", "), strings.Join(values, ", "), t.Name),
+		fmt.Sprintf(`DROP TABLE %s`, t.Name),
+		fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, migrated, t.Name),
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Returns the names of a table's columns and those of its primary key in
+// order.
+func sqliteTableInfo(db *sql.DB, name string) (map[string]bool, []string, error) {
+	rows, err := db.Query(fmt.Sprintf(`SELECT name, pk FROM pragma_table_info('%s')`, name))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	keyPositions := make(map[int]string)
+	for rows.Next() {
+		var column string
+		var position int
+		err = rows.Scan(&column, &position)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		columns[column] = true
+		if position > 0 {
+			keyPositions[position] = column
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	key := make([]string, len(keyPositions))
+	for position, column := range keyPositions {
+		key[position-1] = column
+	}
+	return columns, key, nil
+}
+
+func (s *sqliteSink) Begin() (Batch, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteBatch{tx: tx, history: s.history}, nil
+}
+
+func (s *sqliteSink) Checkpoint() (*uint64, error) {
+	var sequence int64
+	err := s.db.QueryRow(`SELECT sequence FROM checkpoints WHERE name = 'feed'`).
+		Scan(&sequence)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seq := uint64(sequence)
+	return &seq, nil
+}
+
+func (s *sqliteSink) Close() error {
+	return s.db.Close()
+}
+
+type sqliteBatch struct {
+	tx      *sql.Tx
+	history bool
+}
+
+func (b *sqliteBatch) ArchiveEvents(events []Event) error {
+	statement, err := b.tx.Prepare(`
+		INSERT INTO events (sequence, id, type, created, data)
+		VALUES ($1, $2, $3, $4, $5)`)
+	if err != nil {
+		return err
+	}
+	defer statement.Close()
+
+	for _, event := range events {
+		_, err = statement.Exec(
+			int64(event.Sequence),
+			event.ID,
+			event.Type,
+			time.Unix(event.Created, 0).UTC(),
+			string(event.Raw),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteRows upserts rows one at a time. Rows are in event order, so a later
+// version of an object in the same batch replaces an earlier one. A row that
+// doesn't update anything was older than the stored one, and one that wasn't
+// created after its object's deletion is never written at all. In either case,
+// its child rows and history are left alone too.
+func (b *sqliteBatch) WriteRows(table *Table, rows []Row) (int, error) {
+	deleted, err := b.tx.Prepare(fmt.Sprintf(
+		`SELECT count(*) FROM deletions
+		WHERE table_name = $1 AND %s AND event_created >= $%v`,
+		keyConditions(table.Key, 2), len(table.Key)+2))
+	if err != nil {
+		return 0, err
+	}
+	defer deleted.Close()
+
+	var assignments []string
+	for _, name := range table.NonKeyColumnNames() {
+		assignments = append(assignments, fmt.Sprintf("%s = excluded.%s", name, name))
+	}
+
+	upsert, err := b.tx.Prepare(fmt.Sprintf(
+		`INSERT INTO %s (%s) VALUES (%s)
+		ON CONFLICT (%s) DO UPDATE SET %s
+		WHERE (coalesce(%s.event_created, ''), %s.sequence)
+			<= (excluded.event_created, excluded.sequence)`,
+		table.Name,
+		strings.Join(table.ColumnNames(), ", "),
+		placeholders(1, len(table.Columns)),
+		strings.Join(table.Key, ", "),
+		strings.Join(assignments, ", "),
+		table.Name, table.Name,
+	))
+	if err != nil {
+		return 0, err
+	}
+	defer upsert.Close()
+
+	numStale := 0
+	for _, row := range rows {
+		if row.Deleted {
+			err = b.deleteRow(table, row)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		var numDeletions int
+		err = deleted.QueryRow(append(append([]interface{}{table.Name}, table.KeyValues(row.Values)...),
+			row.Values[columnIndex(table, "event_created")])...).
+			Scan(&numDeletions)
+		if err != nil {
+			return 0, err
+		}
+		if numDeletions > 0 {
+			numStale++
+			continue
+		}
+
+		result, err := upsert.Exec(row.Values...)
+		if err != nil {
+			return 0, err
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if affected == 0 {
+			numStale++
+			continue
+		}
+
+		for _, child := range table.Children {
+			childRows, ok := row.Children[child]
+			if !ok {
+				continue
+			}
+
+			err = b.replaceChildRows(table, child, row, childRows)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if b.history {
+			err = b.writeHistory(table, row)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return numStale, nil
+}
+
+// Deletes the row of a deleted object along with its child rows, closes its
+// current version in the history, and records the deletion. A row that's
+// newer than the deletion is left alone.
+func (b *sqliteBatch) deleteRow(table *Table, row Row) error {
+	keyValues := table.KeyValues(row.Values)
+	sequence := int64(row.Event.Sequence)
+	created := time.Unix(row.Event.Created, 0).UTC()
+
+	// Parameters are numbered in order of their first appearance so that
+	// SQLite binds them in the right order.
+	_, err := b.tx.Exec(fmt.Sprintf(
+		`INSERT INTO deletions (table_name, %s, event_created, sequence)
+		VALUES ($1, %s, $%v, $%v)
+		ON CONFLICT (table_name, %s) DO UPDATE SET
+			event_created = excluded.event_created,
+			sequence = excluded.sequence
+		WHERE (deletions.event_created, deletions.sequence)
+			< (excluded.event_created, excluded.sequence)`,
+		strings.Join(table.Key, ", "), placeholders(2, len(table.Key)),
+		len(table.Key)+2, len(table.Key)+3, strings.Join(table.Key, ", ")),
+		append(append([]interface{}{table.Name}, keyValues...), created, sequence)...)
+	if err != nil {
+		return err
+	}
+
+	result, err := b.tx.Exec(fmt.Sprintf(
+		`DELETE FROM %s WHERE %s
+			AND (coalesce(event_created, ''), sequence) <= ($%v, $%v)`,
+		table.Name, keyConditions(table.Key, 1), len(table.Key)+1, len(table.Key)+2),
+		append(append([]interface{}(nil), keyValues...), created, sequence)...)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return nil
+	}
+
+	for _, child := range table.Children {
+		_, err := b.tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s`,
+			child.Name, keyConditions(child.ParentKey, 1)), keyValues...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !b.history {
+		return nil
+	}
+
+	_, err = b.tx.Exec(fmt.Sprintf(
+		`UPDATE %s SET valid_to_sequence = $1, valid_to = $2
+		WHERE %s AND valid_to_sequence IS NULL AND valid_from_sequence < $1`,
+		table.HistoryName(), keyConditions(table.Key, 3)),
+		append([]interface{}{sequence, created}, keyValues...)...)
+	return err
+}
+
+// Closes the current version of a row in its history table and inserts a new
+// one.
+func (b *sqliteBatch) writeHistory(table *Table, row Row) error {
+	sequence := int64(row.Event.Sequence)
+	created := time.Unix(row.Event.Created, 0).UTC()
+
+	var conditions []string
+	for i, key := range table.Key {
+		conditions = append(conditions, fmt.Sprintf("%s = $%v", key, i+3))
+	}
+	keyValues := append([]interface{}{sequence, created}, table.KeyValues(row.Values)...)
+
+	_, err := b.tx.Exec(fmt.Sprintf(
+		`UPDATE %s SET valid_to_sequence = $1, valid_to = $2
+		WHERE %s AND valid_to_sequence IS NULL AND valid_from_sequence < $1`,
+		table.HistoryName(),
+		strings.Join(conditions, " AND "),
+	), keyValues...)
+	if err != nil {
+		return err
+	}
+
+	// Ignore conflicts so that reloading an event that's already in the
+	// history doesn't fail.
+	_, err = b.tx.Exec(fmt.Sprintf(
+		`INSERT OR IGNORE INTO %s (%s, valid_from_sequence, valid_from)
+		VALUES (%s)`,
+		table.HistoryName(),
+		strings.Join(table.ColumnNames(), ", "),
+		placeholders(1, len(table.Columns)+2),
+	), append(append([]interface{}(nil), row.Values...), sequence, created)...)
+	return err
+}
+
+// Replaces every row of a child table belonging to a parent row.
+func (b *sqliteBatch) replaceChildRows(table, child *Table, row Row, childRows [][]interface{}) error {
+	var conditions []string
+	for i, key := range child.ParentKey {
+		conditions = append(conditions, fmt.Sprintf("%s = $%v", key, i+1))
+	}
+
+	_, err := b.tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s`,
+		child.Name, strings.Join(conditions, " AND ")),
+		table.KeyValues(row.Values)...)
+	if err != nil {
+		return err
+	}
+
+	for _, values := range childRows {
+		_, err = b.tx.Exec(fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s)`,
+			child.Name,
+			strings.Join(child.ColumnNames(), ", "),
+			placeholders(1, len(child.Columns)),
+		), values...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *sqliteBatch) WriteDeadLetters(deadLetters []DeadLetter) error {
+	for _, deadLetter := range deadLetters {
+		event := deadLetter.Event
+		_, err := b.tx.Exec(`
+			INSERT INTO dead_letter_events
+				(sequence, id, type, error, data, failed_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (sequence) DO UPDATE SET
+				error = excluded.error,
+				failed_at = excluded.failed_at,
+				attempts = dead_letter_events.attempts + 1`,
+			int64(event.Sequence),
+			event.ID,
+			event.Type,
+			deadLetter.Err.Error(),
+			string(event.Raw),
+			time.Now().UTC(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *sqliteBatch) Commit(sequence uint64) error {
+	_, err := b.tx.Exec(`
+		INSERT INTO checkpoints (name, sequence, updated_at)
+		VALUES ('feed', $1, $2)
+		ON CONFLICT (name) DO UPDATE SET
+			sequence = excluded.sequence,
+			updated_at = excluded.updated_at`,
+		int64(sequence), time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return b.tx.Commit()
+}
+
+func (b *sqliteBatch) Rollback() error {
+	err := b.tx.Rollback()
+	if err == sql.ErrTxDone {
+		return nil
+	}
+	return err
+}
+
+// Generates a CREATE TABLE statement for a typed table or its history, with
+// any extra table constraints like foreign keys.
+func sqliteCreateTable(name string, columns []Column, key []string, constraints ...string) string {
+	var definitions []string
+	for _, column := range columns {
+		definitions = append(definitions,
+			fmt.Sprintf("%s %s", column.Name, sqliteColumnType(column.Type)))
+	}
+	definitions = append(definitions,
+		fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(key, ", ")))
+	definitions = append(definitions, constraints...)
+
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n)",
+		name, strings.Join(definitions, ",\n\t"))
+}
+
+func sqliteColumnType(columnType ColumnType) string {
+	switch columnType {
+	case BigintColumn:
+		return "INTEGER"
+	case BooleanColumn:
+		return "BOOLEAN"
+	case NumericColumn:
+		return "REAL"
+	case TimestampColumn:
+		// go-sqlite3 converts columns declared as TIMESTAMP back to
+		// time.Time when they're read.
+		return "TIMESTAMP"
+	}
+	return "TEXT"
+}
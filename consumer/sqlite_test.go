@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestSQLiteSink(t *testing.T, path string, history bool) *sqliteSink {
+	sink, err := newSQLiteSink(path, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+// Returns an update of a charge, or its deletion if status is empty.
+func testChargeEvent(sequence uint64, created int64, status string, refunds ...string) Event {
+	if status == "" {
+		return Event{
+			Created:  created,
+			Data:     EventData{Object: []byte(`{"id":"ch_123","object":"charge"}`)},
+			Deleted:  true,
+			Sequence: sequence,
+			Type:     "charge.deleted",
+		}
+	}
+
+	var refundObjects []string
+	for _, id := range refunds {
+		refundObjects = append(refundObjects, fmt.Sprintf(
+			`{"id":"%s","amount":100,"created":1500000000,"currency":"usd"}`, id))
+	}
+
+	return Event{
+		Created: created,
+		Data: EventData{Object: []byte(fmt.Sprintf(
+			`{"id":"ch_123","object":"charge","amount":1000,"created":1500000000,
+			"currency":"usd","status":"%s","refunds":{"data":[%s]}}`,
+			status, strings.Join(refundObjects, ",")))},
+		Sequence: sequence,
+		Type:     "charge.updated",
+	}
+}
+
+// Maps events and writes them to the sink in a single batch, returning the
+// number of stale rows.
+func writeSQLiteEvents(t *testing.T, sink *sqliteSink, events ...Event) int {
+	rows, deadLetters := mapEvents(events)
+	if len(deadLetters) > 0 {
+		t.Fatal(deadLetters[0].Err)
+	}
+
+	batch, err := sink.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batch.Rollback()
+
+	numStale := 0
+	for _, table := range tables {
+		n, err := batch.WriteRows(table, rows[table])
+		if err != nil {
+			t.Fatal(err)
+		}
+		numStale += n
+	}
+
+	err = batch.Commit(events[len(events)-1].Sequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return numStale
+}
+
+func queryStrings(t *testing.T, db *sql.DB, query string) []string {
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func TestSQLiteSinkWriteRows(t *testing.T) {
+	type state struct {
+		numStale int
+		charges  string
+		refunds  string
+	}
+
+	testCases := []struct {
+		name   string
+		events [][]Event
+		want   []state
+	}{
+		{
+			name: "Upsert",
+			events: [][]Event{
+				{testChargeEvent(1, 100, "pending", "re_1")},
+				{testChargeEvent(2, 101, "succeeded", "re_1", "re_2")},
+			},
+			want: []state{
+				{0, "ch_123:pending", "re_1"},
+				{0, "ch_123:succeeded", "re_1,re_2"},
+			},
+		},
+		{
+			name: "LaterVersionInSameBatch",
+			events: [][]Event{
+				{testChargeEvent(1, 100, "pending"), testChargeEvent(2, 101, "succeeded", "re_1")},
+			},
+			want: []state{
+				{0, "ch_123:succeeded", "re_1"},
+			},
+		},
+		{
+			name: "StaleRejected",
+			events: [][]Event{
+				{testChargeEvent(2, 101, "succeeded", "re_1")},
+				{testChargeEvent(1, 100, "pending")},
+			},
+			want: []state{
+				{0, "ch_123:succeeded", "re_1"},
+				{1, "ch_123:succeeded", "re_1"},
+			},
+		},
+		{
+			name: "Deletion",
+			events: [][]Event{
+				{testChargeEvent(1, 100, "succeeded", "re_1")},
+				{testChargeEvent(2, 101, "")},
+			},
+			want: []state{
+				{0, "ch_123:succeeded", "re_1"},
+				{0, "", ""},
+			},
+		},
+		{
+			name: "ReplayAfterDeletionRejected",
+			events: [][]Event{
+				{testChargeEvent(2, 101, "")},
+				{testChargeEvent(1, 100, "succeeded", "re_1")},
+				{testChargeEvent(3, 101, "succeeded", "re_1")},
+			},
+			want: []state{
+				{0, "", ""},
+				{1, "", ""},
+				{1, "", ""},
+			},
+		},
+		{
+			name: "RecreatedAfterDeletion",
+			events: [][]Event{
+				{testChargeEvent(1, 100, "succeeded")},
+				{testChargeEvent(2, 101, "")},
+				{testChargeEvent(3, 102, "succeeded", "re_1")},
+			},
+			want: []state{
+				{0, "ch_123:succeeded", ""},
+				{0, "", ""},
+				{0, "ch_123:succeeded", "re_1"},
+			},
+		},
+		{
+			name: "StaleDeletionIgnored",
+			events: [][]Event{
+				{testChargeEvent(2, 101, "succeeded", "re_1")},
+				{testChargeEvent(1, 100, "")},
+			},
+			want: []state{
+				{0, "ch_123:succeeded", "re_1"},
+				{0, "ch_123:succeeded", "re_1"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			sink := newTestSQLiteSink(t, filepath.Join(t.TempDir(), "warehouse.db"), false)
+			defer sink.Close()
+
+			for i, events := range testCase.events {
+				got := state{
+					numStale: writeSQLiteEvents(t, sink, events...),
+					charges: strings.Join(queryStrings(t, sink.db,
+						`SELECT id || ':' || status FROM charges ORDER BY id`), ","),
+					refunds: strings.Join(queryStrings(t, sink.db,
+						`SELECT id FROM charge_refunds ORDER BY id`), ","),
+				}
+				if got != testCase.want[i] {
+					t.Errorf("After batch %v: expected %+v, got %+v", i, testCase.want[i], got)
+				}
+			}
+		})
+	}
+}
+
+func TestSQLiteSinkHistory(t *testing.T) {
+	sink := newTestSQLiteSink(t, filepath.Join(t.TempDir(), "warehouse.db"), true)
+	defer sink.Close()
+
+	writeSQLiteEvents(t, sink, testChargeEvent(1, 100, "pending"))
+	writeSQLiteEvents(t, sink, testChargeEvent(2, 101, "succeeded"))
+
+	// A stale version doesn't make it into the history.
+	writeSQLiteEvents(t, sink, testChargeEvent(1, 100, "pending"))
+
+	versions := queryStrings(t, sink.db, `
+		SELECT status || ':' || valid_from_sequence || '-' || coalesce(valid_to_sequence, '')
+		FROM charges_history ORDER BY valid_from_sequence`)
+	if strings.Join(versions, ",") != "pending:1-2,succeeded:2-" {
+		t.Errorf("Unexpected history: %v", versions)
+	}
+
+	writeSQLiteEvents(t, sink, testChargeEvent(3, 102, ""))
+
+	versions = queryStrings(t, sink.db, `
+		SELECT status || ':' || valid_from_sequence || '-' || coalesce(valid_to_sequence, '')
+		FROM charges_history ORDER BY valid_from_sequence`)
+	if strings.Join(versions, ",") != "pending:1-2,succeeded:2-3" {
+		t.Errorf("Unexpected history after deletion: %v", versions)
+	}
+}
+
+func TestSQLiteSinkMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warehouse.db")
+
+	// The typed tables as they were before accounts, USD amounts, and the
+	// event's creation time were added.
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		`CREATE TABLE charges (id TEXT, amount INTEGER, created TIMESTAMP,
+			currency TEXT, status TEXT, sequence INTEGER, PRIMARY KEY (id))`,
+		`CREATE TABLE charge_refunds (charge TEXT, id TEXT, amount INTEGER,
+			created TIMESTAMP, currency TEXT, reason TEXT, sequence INTEGER,
+			PRIMARY KEY (charge, id))`,
+		`INSERT INTO charges VALUES ('ch_123', 1000, '2017-07-14 02:40:00',
+			'usd', 'succeeded', 2)`,
+		`INSERT INTO charge_refunds VALUES ('ch_123', 're_1', 100,
+			'2017-07-14 02:40:00', 'usd', NULL, 2)`,
+	} {
+		_, err = db.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	sink := newTestSQLiteSink(t, path, false)
+	defer sink.Close()
+
+	charges := queryStrings(t, sink.db, `
+		SELECT account_id || ':' || id || ':' || status || ':' ||
+			coalesce(event_created, 'null') FROM charges`)
+	if strings.Join(charges, ",") != ":ch_123:succeeded:null" {
+		t.Errorf("Unexpected charges: %v", charges)
+	}
+
+	// Rows now have the current key, so writes upsert them rather than
+	// failing, and child rows are deleted along with their parent.
+	if numStale := writeSQLiteEvents(t, sink, testChargeEvent(3, 102, "refunded", "re_1")); numStale != 0 {
+		t.Errorf("Expected no stale rows, got %v", numStale)
+	}
+	_, err = sink.db.Exec(`DELETE FROM charges`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refunds := queryStrings(t, sink.db, `SELECT id FROM charge_refunds`); len(refunds) != 0 {
+		t.Errorf("Expected refunds to be deleted with their charge, got %v", refunds)
+	}
+
+	// Opening an up-to-date database again leaves it alone.
+	newTestSQLiteSink(t, path, false).Close()
+}
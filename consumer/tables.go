@@ -0,0 +1,631 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ColumnType is the type of a column in a typed table. Each sink maps it to
+// the closest type that its storage supports.
+type ColumnType int
+
+const (
+	BigintColumn ColumnType = iota
+	BooleanColumn
+
+	// NumericColumn is a decimal number like an amount in USD. Values are
+	// decimal strings so that they're exact.
+	NumericColumn
+
+	TextColumn
+	TimestampColumn
+)
+
+// Column is a single column of a typed table.
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// Table is a typed warehouse table that's derived from events in the feed.
+// The same definition is used both when loading pages from the feed and when
+// rebuilding a table from the raw event archive so that the two can never
+// disagree, and by every sink so that they all share the same schema.
+//
+// Typed tables hold the current state of each object: a row is inserted the
+// first time an object is seen and replaced by every later event carrying
+// it. Every table has an `account_id` column holding the connected account
+// that the object belongs to (empty for the platform's own objects), which
+// leads its key because object IDs are only unique within an account, and a
+// `sequence` column holding the sequence of the event that it was last
+// written from.
+//
+// Note that the Postgres schema is managed by migrations in db/migrations,
+// which need to be kept in line with these definitions.
+type Table struct {
+	Name    string
+	Columns []Column
+
+	// Key is the names of the columns making up the table's primary key.
+	Key []string
+
+	// Object is the type of object that the table is derived from. Only
+	// events carrying an object of this type are passed to Row.
+	Object string
+
+	// Row maps an event and its decoded object to a row for the table with
+	// values in the same order as Columns. It returns a nil row if the event
+	// doesn't produce one.
+	Row func(event *Event, object interface{}) ([]interface{}, error)
+
+	// Children are tables holding the items of lists nested in the table's
+	// objects, like a charge's refunds. They're written along with the
+	// parent, and every time a parent row is written its child rows are
+	// replaced wholesale so that items removed from the list disappear too.
+	Children []*Table
+
+	// ParentKey is set only on child tables, and is the names of the columns
+	// referencing the parent's Key, in the same order.
+	ParentKey []string
+
+	// Rows is used by child tables in place of Row. It maps the parent's
+	// event and object to a row for every item in the nested list, or returns
+	// nil if the object doesn't carry the list at all, in which case any
+	// existing child rows are left alone.
+	Rows func(event *Event, object interface{}) ([][]interface{}, error)
+}
+
+// Row is a row for a typed table along with the event that it was mapped
+// from.
+type Row struct {
+	Event  *Event
+	Values []interface{}
+
+	// Children holds the rows that replace the existing rows of each of the
+	// table's child tables for this row's object. A child table is missing if
+	// its list wasn't present on the object.
+	Children map[*Table][][]interface{}
+
+	// Deleted is set when the row's object was deleted, in which case only
+	// the key and sequence of Values are filled and the row should be
+	// removed rather than written.
+	Deleted bool
+}
+
+var tables = []*Table{
+	{
+		Name: "charges",
+		Columns: []Column{
+			{"account_id", TextColumn},
+			{"id", TextColumn},
+			{"amount", BigintColumn},
+			{"amount_usd", NumericColumn},
+			{"created", TimestampColumn},
+			{"currency", TextColumn},
+			{"customer", TextColumn},
+			{"status", TextColumn},
+			{"event_created", TimestampColumn},
+			{"sequence", BigintColumn},
+		},
+		Key:    []string{"account_id", "id"},
+		Object: "charge",
+		Row: func(event *Event, object interface{}) ([]interface{}, error) {
+			charge := object.(*Charge)
+			return []interface{}{
+				event.Account,
+				charge.ID,
+				charge.Amount,
+				amountUSD(charge.Amount, charge.Currency, charge.Created),
+				time.Unix(charge.Created, 0),
+				charge.Currency,
+				nullString(charge.Customer),
+				nullString(charge.Status),
+				time.Unix(event.Created, 0).UTC(),
+				event.Sequence,
+			}, nil
+		},
+		Children: []*Table{
+			{
+				Name: "charge_refunds",
+				Columns: []Column{
+					{"account_id", TextColumn},
+					{"charge", TextColumn},
+					{"id", TextColumn},
+					{"amount", BigintColumn},
+					{"created", TimestampColumn},
+					{"currency", TextColumn},
+					{"reason", TextColumn},
+					{"sequence", BigintColumn},
+				},
+				Key:       []string{"account_id", "charge", "id"},
+				ParentKey: []string{"account_id", "charge"},
+				Rows: func(event *Event, object interface{}) ([][]interface{}, error) {
+					charge := object.(*Charge)
+					if charge.Refunds == nil {
+						return nil, nil
+					}
+
+					rows := [][]interface{}{}
+					for _, refund := range charge.Refunds.Data {
+						rows = append(rows, []interface{}{
+							event.Account,
+							charge.ID,
+							refund.ID,
+							refund.Amount,
+							time.Unix(refund.Created, 0),
+							refund.Currency,
+							nullString(refund.Reason),
+							event.Sequence,
+						})
+					}
+					return rows, nil
+				},
+			},
+		},
+	},
+	{
+		Name: "customers",
+		Columns: []Column{
+			{"account_id", TextColumn},
+			{"id", TextColumn},
+			{"created", TimestampColumn},
+			{"delinquent", BooleanColumn},
+			{"description", TextColumn},
+			{"email", TextColumn},
+			{"event_created", TimestampColumn},
+			{"sequence", BigintColumn},
+		},
+		Key:    []string{"account_id", "id"},
+		Object: "customer",
+		Row: func(event *Event, object interface{}) ([]interface{}, error) {
+			customer := object.(*Customer)
+			return []interface{}{
+				event.Account,
+				customer.ID,
+				time.Unix(customer.Created, 0),
+				customer.Delinquent,
+				nullString(customer.Description),
+				nullString(customer.Email),
+				time.Unix(event.Created, 0).UTC(),
+				event.Sequence,
+			}, nil
+		},
+	},
+	{
+		Name: "disputes",
+		Columns: []Column{
+			{"account_id", TextColumn},
+			{"id", TextColumn},
+			{"amount", BigintColumn},
+			{"charge", TextColumn},
+			{"created", TimestampColumn},
+			{"currency", TextColumn},
+			{"reason", TextColumn},
+			{"status", TextColumn},
+			{"event_created", TimestampColumn},
+			{"sequence", BigintColumn},
+		},
+		Key:    []string{"account_id", "id"},
+		Object: "dispute",
+		Row: func(event *Event, object interface{}) ([]interface{}, error) {
+			dispute := object.(*Dispute)
+			return []interface{}{
+				event.Account,
+				dispute.ID,
+				dispute.Amount,
+				dispute.Charge,
+				time.Unix(dispute.Created, 0),
+				dispute.Currency,
+				nullString(dispute.Reason),
+				dispute.Status,
+				time.Unix(event.Created, 0).UTC(),
+				event.Sequence,
+			}, nil
+		},
+	},
+	{
+		Name: "invoices",
+		Columns: []Column{
+			{"account_id", TextColumn},
+			{"id", TextColumn},
+			{"amount_due", BigintColumn},
+			{"created", TimestampColumn},
+			{"currency", TextColumn},
+			{"customer", TextColumn},
+			{"paid", BooleanColumn},
+			{"subscription", TextColumn},
+			{"total", BigintColumn},
+			{"event_created", TimestampColumn},
+			{"sequence", BigintColumn},
+		},
+		Key:    []string{"account_id", "id"},
+		Object: "invoice",
+		Row: func(event *Event, object interface{}) ([]interface{}, error) {
+			invoice := object.(*Invoice)
+			return []interface{}{
+				event.Account,
+				invoice.ID,
+				invoice.AmountDue,
+				time.Unix(invoice.Date, 0),
+				invoice.Currency,
+				invoice.Customer,
+				invoice.Paid,
+				nullString(invoice.Subscription),
+				invoice.Total,
+				time.Unix(event.Created, 0).UTC(),
+				event.Sequence,
+			}, nil
+		},
+		Children: []*Table{
+			{
+				Name: "invoice_lines",
+				Columns: []Column{
+					{"account_id", TextColumn},
+					{"invoice", TextColumn},
+					{"id", TextColumn},
+					{"amount", BigintColumn},
+					{"currency", TextColumn},
+					{"description", TextColumn},
+					{"period_end", TimestampColumn},
+					{"period_start", TimestampColumn},
+					{"plan_id", TextColumn},
+					{"proration", BooleanColumn},
+					{"quantity", BigintColumn},
+					{"subscription", TextColumn},
+					{"type", TextColumn},
+					{"sequence", BigintColumn},
+				},
+				// Line items for a subscription are identified by the
+				// subscription's ID, which repeats across invoices, so lines
+				// are only unique within their invoice.
+				Key:       []string{"account_id", "invoice", "id"},
+				ParentKey: []string{"account_id", "invoice"},
+				Rows: func(event *Event, object interface{}) ([][]interface{}, error) {
+					invoice := object.(*Invoice)
+					if invoice.Lines == nil {
+						return nil, nil
+					}
+
+					rows := [][]interface{}{}
+					for _, line := range invoice.Lines.Data {
+						var planID interface{}
+						if line.Plan != nil {
+							planID = line.Plan.ID
+						}
+
+						var quantity interface{}
+						if line.Quantity != nil {
+							quantity = *line.Quantity
+						}
+
+						rows = append(rows, []interface{}{
+							event.Account,
+							invoice.ID,
+							line.ID,
+							line.Amount,
+							line.Currency,
+							nullString(line.Description),
+							time.Unix(line.Period.End, 0),
+							time.Unix(line.Period.Start, 0),
+							planID,
+							line.Proration,
+							quantity,
+							nullString(line.Subscription),
+							line.Type,
+							event.Sequence,
+						})
+					}
+					return rows, nil
+				},
+			},
+		},
+	},
+	{
+		Name: "subscriptions",
+		Columns: []Column{
+			{"account_id", TextColumn},
+			{"id", TextColumn},
+			{"canceled_at", TimestampColumn},
+			{"created", TimestampColumn},
+			{"customer", TextColumn},
+			{"plan_amount", BigintColumn},
+			{"plan_currency", TextColumn},
+			{"plan_id", TextColumn},
+			{"plan_interval", TextColumn},
+			{"plan_interval_count", BigintColumn},
+			{"quantity", BigintColumn},
+			{"status", TextColumn},
+			{"event_created", TimestampColumn},
+			{"sequence", BigintColumn},
+		},
+		Key:    []string{"account_id", "id"},
+		Object: "subscription",
+		Row: func(event *Event, object interface{}) ([]interface{}, error) {
+			subscription := object.(*Subscription)
+			return []interface{}{
+				event.Account,
+				subscription.ID,
+				nullTime(subscription.CanceledAt),
+				time.Unix(subscription.Created, 0),
+				subscription.Customer,
+				subscription.Plan.Amount,
+				subscription.Plan.Currency,
+				subscription.Plan.ID,
+				subscription.Plan.Interval,
+				subscription.Plan.IntervalCount,
+				subscription.Quantity,
+				subscription.Status,
+				time.Unix(event.Created, 0).UTC(),
+				event.Sequence,
+			}, nil
+		},
+		Children: []*Table{
+			{
+				Name: "subscription_items",
+				Columns: []Column{
+					{"account_id", TextColumn},
+					{"subscription", TextColumn},
+					{"id", TextColumn},
+					{"created", TimestampColumn},
+					{"plan_id", TextColumn},
+					{"quantity", BigintColumn},
+					{"sequence", BigintColumn},
+				},
+				Key:       []string{"account_id", "subscription", "id"},
+				ParentKey: []string{"account_id", "subscription"},
+				Rows: func(event *Event, object interface{}) ([][]interface{}, error) {
+					subscription := object.(*Subscription)
+					if subscription.Items == nil {
+						return nil, nil
+					}
+
+					rows := [][]interface{}{}
+					for _, item := range subscription.Items.Data {
+						rows = append(rows, []interface{}{
+							event.Account,
+							subscription.ID,
+							item.ID,
+							time.Unix(item.Created, 0),
+							item.Plan.ID,
+							item.Quantity,
+							event.Sequence,
+						})
+					}
+					return rows, nil
+				},
+			},
+		},
+	},
+}
+
+// Decodes events and maps them to rows for every table. Events that fail at
+// either step are returned as dead letters rather than rows, and none of
+// their rows are included so that an event is never partially loaded.
+//
+// Rows for each table are in the same order as the events they came from.
+func mapEvents(events []Event) (map[*Table][]Row, []DeadLetter) {
+	rows := make(map[*Table][]Row)
+	var deadLetters []DeadLetter
+
+EventsLoop:
+	for i := range events {
+		event := &events[i]
+
+		if event.Deleted {
+			for table, row := range deletedRows(event) {
+				rows[table] = append(rows[table], row)
+			}
+			continue
+		}
+
+		err := decodeEvent(event)
+		if err != nil {
+			deadLetters = append(deadLetters, DeadLetter{Event: event, Err: err})
+			continue
+		}
+
+		if event.Object == nil {
+			continue
+		}
+
+		eventRows := make(map[*Table]Row)
+		for _, table := range tables {
+			if event.ObjectType != table.Object {
+				continue
+			}
+
+			values, err := table.Row(event, event.Object)
+			if err != nil {
+				deadLetters = append(deadLetters, DeadLetter{
+					Event: event,
+					Err: fmt.Errorf("Couldn't map event at sequence %v (%v) to %v: %v",
+						event.Sequence, event.Type, table.Name, err),
+				})
+				continue EventsLoop
+			}
+
+			if values == nil {
+				continue
+			}
+
+			row := Row{Event: event, Values: values}
+			for _, child := range table.Children {
+				childRows, err := child.Rows(event, event.Object)
+				if err != nil {
+					deadLetters = append(deadLetters, DeadLetter{
+						Event: event,
+						Err: fmt.Errorf("Couldn't map event at sequence %v (%v) to %v: %v",
+							event.Sequence, event.Type, child.Name, err),
+					})
+					continue EventsLoop
+				}
+
+				if childRows != nil {
+					if row.Children == nil {
+						row.Children = make(map[*Table][][]interface{})
+					}
+					row.Children[child] = childRows
+				}
+			}
+			eventRows[table] = row
+		}
+
+		for table, row := range eventRows {
+			rows[table] = append(rows[table], row)
+		}
+	}
+
+	return rows, deadLetters
+}
+
+// Returns rows that remove the object of a deletion event from each table
+// that models its type. Deletion events carry only the object's ID and type.
+func deletedRows(event *Event) map[*Table]Row {
+	var object struct {
+		ID     string `json:"id"`
+		Object string `json:"object"`
+	}
+	err := json.Unmarshal(event.Data.Object, &object)
+	if err != nil || object.ID == "" {
+		return nil
+	}
+
+	rows := make(map[*Table]Row)
+	for _, table := range tables {
+		if table.Object != object.Object {
+			continue
+		}
+
+		values := make([]interface{}, len(table.Columns))
+		values[columnIndex(table, "account_id")] = event.Account
+		values[columnIndex(table, "id")] = object.ID
+		values[columnIndex(table, "sequence")] = event.Sequence
+		rows[table] = Row{Event: event, Values: values, Deleted: true}
+	}
+	return rows
+}
+
+// Splits rows into those to be written and those whose objects were deleted.
+func splitDeletions(rows []Row) ([]Row, []Row) {
+	var written, deleted []Row
+	for _, row := range rows {
+		if row.Deleted {
+			deleted = append(deleted, row)
+		} else {
+			written = append(written, row)
+		}
+	}
+	return written, deleted
+}
+
+// historyColumns are added to a table's columns to make up its history
+// table. A version is valid from the event that produced it up until (but
+// not including) the event that produced the next version, and the version
+// with no valid_to_sequence is current.
+var historyColumns = []Column{
+	{"valid_from_sequence", BigintColumn},
+	{"valid_to_sequence", BigintColumn},
+	{"valid_from", TimestampColumn},
+	{"valid_to", TimestampColumn},
+}
+
+// HistoryName returns the name of the table that holds every version of the
+// table's rows when history is enabled.
+func (t *Table) HistoryName() string {
+	return t.Name + "_history"
+}
+
+// NonKeyColumnNames returns the names of the columns that aren't part of the
+// table's primary key.
+func (t *Table) NonKeyColumnNames() []string {
+	var names []string
+	for _, name := range t.ColumnNames() {
+		isKey := false
+		for _, key := range t.Key {
+			if name == key {
+				isKey = true
+				break
+			}
+		}
+		if !isKey {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ColumnNames returns the names of the table's columns in order.
+func (t *Table) ColumnNames() []string {
+	names := make([]string, len(t.Columns))
+	for i, column := range t.Columns {
+		names[i] = column.Name
+	}
+	return names
+}
+
+// Returns the values of a row's key columns.
+func (t *Table) KeyValues(values []interface{}) []interface{} {
+	keyValues := make([]interface{}, len(t.Key))
+	for i, key := range t.Key {
+		keyValues[i] = values[columnIndex(t, key)]
+	}
+	return keyValues
+}
+
+// childReplacement is the set of rows that replaces every existing row of a
+// child table for a single parent.
+type childReplacement struct {
+	ParentKey []interface{}
+	Rows      [][]interface{}
+}
+
+// Returns the latest child rows for each parent among rows whose list was
+// present, in the order that parents first appear. Rows are in event order,
+// so a later version of a parent replaces an earlier one.
+func latestChildRows(table, child *Table, rows []Row) []*childReplacement {
+	var replacements []*childReplacement
+	byKey := make(map[string]*childReplacement)
+	for _, row := range rows {
+		childRows, ok := row.Children[child]
+		if !ok {
+			continue
+		}
+
+		keyValues := table.KeyValues(row.Values)
+		key := fmt.Sprintf("%q", keyValues)
+		replacement, ok := byKey[key]
+		if !ok {
+			replacement = &childReplacement{ParentKey: keyValues}
+			byKey[key] = replacement
+			replacements = append(replacements, replacement)
+		}
+		replacement.Rows = childRows
+	}
+	return replacements
+}
+
+func findTable(name string) *Table {
+	for _, table := range tables {
+		if table.Name == name {
+			return table
+		}
+	}
+	return nil
+}
+
+// Returns nil for an empty string so that it's stored as NULL.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// Returns nil for a missing timestamp so that it's stored as NULL.
+func nullTime(t *int64) interface{} {
+	if t == nil {
+		return nil
+	}
+	return time.Unix(*t, 0)
+}
@@ -10,6 +10,8 @@ import (
 
 	"github.com/NYTimes/gziphandler"
 	"github.com/Shopify/sarama"
+	"github.com/brandur/stripe-warehouse/envelope"
+	"github.com/brandur/stripe-warehouse/redact"
 	"github.com/joeshaw/envdecode"
 )
 
@@ -24,6 +26,14 @@ var (
 
 type Conf struct {
 	KafkaTopic string `env:"KAFKA_TOPIC,required"`
+
+	// Optional policy for redacting personal information from event objects
+	// before they're served, in the same format as the consumer's. REDACT_KEY
+	// keys hashed values, so use the same one as the consumer for hashes to
+	// match.
+	RedactKey    string `env:"REDACT_KEY"`
+	RedactPolicy string `env:"REDACT_POLICY"`
+
 	SeedBroker string `env:"SEED_BROKER,default=localhost:9092"`
 }
 
@@ -41,7 +51,19 @@ func main() {
 		log.Fatal(err)
 	}
 
-	consumer, err := sarama.NewConsumer(strings.Split(conf.SeedBroker, ","), nil)
+	var policy *redact.Policy
+	if conf.RedactPolicy != "" {
+		policy, err = redact.Parse(conf.RedactPolicy, []byte(conf.RedactKey))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Headers are only returned by Kafka 0.11 and later.
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_11_0_0
+
+	consumer, err := sarama.NewConsumer(strings.Split(conf.SeedBroker, ","), config)
 	if err != nil {
 		panic(err)
 	}
@@ -102,9 +124,33 @@ func main() {
 				}
 
 				var event map[string]interface{}
-				err := json.Unmarshal(message.Value, &event)
-				if err != nil {
-					log.Fatalln(err)
+				if message.Value == nil {
+					// Skip the tombstones of erasures, which only exist so
+					// that compaction removes an erased object's earlier
+					// messages. Those of deletions are served as an event
+					// whose object is marked deleted.
+					if envelope.IsErasure(message) {
+						break
+					}
+					event = envelope.TombstoneFields(message)
+				} else {
+					err := json.Unmarshal(message.Value, &event)
+					if err != nil {
+						log.Fatalln(err)
+					}
+
+					// Redaction depends on knowing where an event keeps its
+					// object, so an envelope that's newer than we understand
+					// is served without its data rather than risk leaking
+					// it. Failing the page instead would leave every consumer
+					// stuck at this offset, whereas the consumer dead letters
+					// the event on its version.
+					version, _ := event["envelope_version"].(float64)
+					err = envelope.CheckVersion(int(version))
+					if err != nil && policy != nil {
+						log.Printf("Serving message at offset %v without its data: %v", message.Offset, err)
+						event = stripEvent(event)
+					}
 				}
 
 				// Fill the event's new `sequence` field (the public name for
@@ -112,6 +158,18 @@ func main() {
 				// offset-style pagination parameter).
 				event["sequence"] = message.Offset
 
+				// Events for connected accounts are tagged with the account
+				// in a header, which the event itself may not include.
+				if _, ok := event[envelope.AccountHeader]; !ok {
+					if account := envelope.Header(message, envelope.AccountHeader); account != "" {
+						event[envelope.AccountHeader] = account
+					}
+				}
+
+				if policy != nil {
+					redactEvent(policy, event)
+				}
+
 				events = append(events, &event)
 				//log.Printf("Consumed message. Now have %v event(s).", len(events))
 
@@ -157,3 +215,30 @@ func main() {
 	log.Printf("Starting HTTP server")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
+
+// Returns an event with only the fields that identify it, for an event whose
+// data can't safely be served.
+func stripEvent(event map[string]interface{}) map[string]interface{} {
+	stripped := make(map[string]interface{})
+	for _, key := range []string{"id", "object", "type", "created", "livemode", "envelope_version",
+		envelope.AccountHeader} {
+		if value, ok := event[key]; ok {
+			stripped[key] = value
+		}
+	}
+	return stripped
+}
+
+// Redacts an event's object and previous attributes in place.
+func redactEvent(policy *redact.Policy, event map[string]interface{}) {
+	data, ok := event["data"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for _, key := range []string{"object", "previous_attributes"} {
+		if object, ok := data[key].(map[string]interface{}); ok {
+			policy.Apply(object)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Package envelope defines the format that events are produced into Kafka in.
+// It's shared by the feeder and synthesizer so that the endpoint and consumer
+// only ever see one shape of event no matter where it came from.
+package envelope
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// Version of the envelope format. Bump it on any change that readers need to
+// know about, and teach readers to handle the new version before producing
+// it.
+const Version = 1
+
+// Names of the Kafka headers set on every message so that it can be routed or
+// filtered without decoding its value, and so that a tombstone still says
+// which event it was.
+const (
+	AccountHeader = "account"
+	CreatedHeader = "created"
+	IDHeader      = "id"
+	TypeHeader    = "type"
+)
+
+// Events that mean their object no longer exists. They're produced as
+// tombstones (messages with a null value) keyed by the object's ID so that
+// compaction removes the object's earlier messages instead of retaining them
+// forever. Note that `customer.subscription.deleted` isn't one of them
+// because it means that a subscription ended, and the subscription remains.
+var DeletionEventTypes = map[string]bool{
+	"coupon.deleted":      true,
+	"customer.deleted":    true,
+	"invoice.deleted":     true,
+	"invoiceitem.deleted": true,
+	"plan.deleted":        true,
+	"product.deleted":     true,
+	"recipient.deleted":   true,
+	"sku.deleted":         true,
+}
+
+// Envelope is an event's metadata along with its object and previous
+// attributes, which are kept exactly as Stripe sent them.
+type Envelope struct {
+	// Account is the connected account that the event belongs to, or empty
+	// for the platform's own events.
+	Account string `json:"account,omitempty"`
+
+	Created  int64  `json:"created"`
+	Data     Data   `json:"data"`
+	ID       string `json:"id"`
+	Livemode bool   `json:"livemode"`
+	Type     string `json:"type"`
+
+	// Version is the envelope format's version, and is set to Version when
+	// the envelope is encoded.
+	Version int `json:"envelope_version"`
+}
+
+// Data holds an event's object and the attributes that changed, left
+// undecoded.
+type Data struct {
+	Object             json.RawMessage `json:"object"`
+	PreviousAttributes json.RawMessage `json:"previous_attributes,omitempty"`
+}
+
+// CheckVersion returns an error if an envelope's version isn't one that this
+// build knows how to read. Messages produced before the envelope was
+// versioned have no version (0), and are read as they are.
+func CheckVersion(version int) error {
+	if version < 0 || version > Version {
+		return fmt.Errorf("Unsupported envelope version %v (the newest supported is %v)",
+			version, Version)
+	}
+	return nil
+}
+
+// ObjectID returns the ID of the event's object, which is what its message
+// is keyed by. An object without an ID is an error because every such
+// message would share the same empty key and be compacted away.
+func (e *Envelope) ObjectID() (string, error) {
+	var object struct {
+		ID string `json:"id"`
+	}
+	err := json.Unmarshal(e.Data.Object, &object)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't decode object of event %v: %v", e.ID, err)
+	}
+	if object.ID == "" {
+		return "", fmt.Errorf("Object of event %v (%v) has no ID", e.ID, e.Type)
+	}
+	return object.ID, nil
+}
+
+// Message returns the Kafka message that produces the event to topic. It's
+// keyed by the ID of the event's object so that compaction keeps only the
+// latest message of each object, and deletion events are tombstones whose
+// headers are all that's left of them.
+func (e *Envelope) Message(topic string) (*sarama.ProducerMessage, error) {
+	key, err := e.ObjectID()
+	if err != nil {
+		return nil, err
+	}
+
+	message := &sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(key),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(CreatedHeader), Value: []byte(strconv.FormatInt(e.Created, 10))},
+			{Key: []byte(IDHeader), Value: []byte(e.ID)},
+			{Key: []byte(TypeHeader), Value: []byte(e.Type)},
+		},
+	}
+	if e.Account != "" {
+		message.Headers = append(message.Headers,
+			sarama.RecordHeader{Key: []byte(AccountHeader), Value: []byte(e.Account)})
+	}
+
+	if DeletionEventTypes[e.Type] {
+		return message, nil
+	}
+
+	e.Version = Version
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	message.Value = sarama.ByteEncoder(data)
+	return message, nil
+}
+
+// Header returns the value of a message's header, or an empty string if it
+// doesn't have it.
+func Header(message *sarama.ConsumerMessage, key string) string {
+	for _, header := range message.Headers {
+		if string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// IsErasure returns whether a message is the tombstone of an erasure. Unlike
+// those of deletions, these only exist so that compaction removes an erased
+// object's earlier messages, and carry no event.
+func IsErasure(message *sarama.ConsumerMessage) bool {
+	return message.Value == nil && Header(message, TypeHeader) == ""
+}
+
+// TombstoneFields returns the fields of the event that a deletion's tombstone
+// stands for, rebuilt from its key and headers. The event is marked
+// `deleted`, and its object carries only its ID and type.
+func TombstoneFields(message *sarama.ConsumerMessage) map[string]interface{} {
+	eventType := Header(message, TypeHeader)
+	created, _ := strconv.ParseInt(Header(message, CreatedHeader), 10, 64)
+
+	return map[string]interface{}{
+		"created": created,
+		"data": map[string]interface{}{
+			"object": map[string]interface{}{
+				"deleted": true,
+				"id":      string(message.Key),
+				"object":  strings.TrimSuffix(eventType, ".deleted"),
+			},
+		},
+		"deleted": true,
+		"id":      Header(message, IDHeader),
+		"type":    eventType,
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/brandur/stripe-warehouse/envelope"
 	"github.com/joeshaw/envdecode"
 	_ "github.com/lib/pq"
 	"github.com/stripe/stripe-go"
@@ -21,9 +26,41 @@ const (
 )
 
 type Conf struct {
+	// Whether to keep polling for new events after reaching the newest one
+	// instead of exiting. Polls are POLL_INTERVAL apart, and the interval
+	// doubles up to POLL_MAX_INTERVAL while no new events are found.
+	Daemon          bool          `env:"DAEMON,default=false"`
+	PollInterval    time.Duration `env:"POLL_INTERVAL,default=5s"`
+	PollMaxInterval time.Duration `env:"POLL_MAX_INTERVAL,default=2m"`
+
 	KafkaTopic string `env:"KAFKA_TOPIC"`
+
+	// How events are received: "poll" to page through the events API, or
+	// "webhook" to serve Stripe webhook deliveries on WEBHOOK_ADDR.
+	Mode string `env:"MODE,default=poll"`
+
 	SeedBroker string `env:"SEED_BROKER,default=localhost:9092"`
 	StripeKey  string `env:"STRIPE_KEY,required"`
+
+	// File that the ID of the newest event produced for each account is
+	// saved to after every batch so that the feeder resumes where it left
+	// off.
+	StatePath string `env:"STATE_PATH,default=feeder-state.json"`
+
+	// Comma-separated list of connected accounts whose events are fed in
+	// turn. If empty, only the platform's own events are fed.
+	StripeAccounts string `env:"STRIPE_ACCOUNTS"`
+
+	// Used only when receiving webhooks. WEBHOOK_SECRETS is a
+	// comma-separated list of endpoint signing secrets, any of which may
+	// have signed a delivery, and deliveries signed longer than
+	// WEBHOOK_TOLERANCE ago are rejected. The IDs of produced events are
+	// saved to WEBHOOK_SEEN_PATH so that redeliveries are recognized even
+	// after a restart.
+	WebhookAddr      string        `env:"WEBHOOK_ADDR,default=:8080"`
+	WebhookSecrets   string        `env:"WEBHOOK_SECRETS"`
+	WebhookSeenPath  string        `env:"WEBHOOK_SEEN_PATH,default=feeder-webhooks.log"`
+	WebhookTolerance time.Duration `env:"WEBHOOK_TOLERANCE,default=5m"`
 }
 
 func main() {
@@ -36,7 +73,12 @@ func main() {
 	stripe.Key = conf.StripeKey
 	//stripe.LogLevel = 1 // errors only
 
-	producer, err := sarama.NewSyncProducer(strings.Split(conf.SeedBroker, ","), nil)
+	// Headers need at least Kafka 0.11.
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_11_0_0
+	config.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(strings.Split(conf.SeedBroker, ","), config)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -46,37 +88,97 @@ func main() {
 		}
 	}()
 
-	log.Printf("Tailing the log")
-	err = tailLog(producer, conf.KafkaTopic)
+	// An empty account stands in for the platform itself.
+	accounts := []string{""}
+	if conf.StripeAccounts != "" {
+		accounts = strings.Split(conf.StripeAccounts, ",")
+	}
+
+	state, err := loadState(conf.StatePath)
 	if err != nil {
 		log.Fatal(err)
 	}
-}
 
-func processBatch(producer sarama.SyncProducer, topic string, events []*stripe.Event) error {
-	for _, event := range events {
-		data, err := json.Marshal(event.Data.Obj)
+	// On a SIGTERM or interrupt, finish the batch that's in flight and save
+	// its checkpoint before exiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Printf("Interrupted. Finishing the in-flight batch before exiting.")
+		cancel()
+	}()
+
+	if conf.Mode == "webhook" {
+		err = serveWebhooks(ctx, producer, conf)
 		if err != nil {
-			return err
+			log.Fatal(err)
 		}
+		return
+	}
+	if conf.Mode != "poll" {
+		log.Fatalf("Unknown mode: %v", conf.Mode)
+	}
 
-		id := event.Data.Obj["id"]
-		if id == nil {
-			log.Printf("Found event with nil data ID, type is %v", event.Type)
+	interval := conf.PollInterval
+	for {
+		numProduced := 0
+		for _, account := range accounts {
+			if ctx.Err() != nil {
+				break
+			}
+
+			if account == "" {
+				log.Printf("Tailing the log")
+			} else {
+				log.Printf("Tailing the log for account %v", account)
+			}
+
+			n, err := tailLog(ctx, producer, conf.KafkaTopic, account, state)
+			if err != nil {
+				log.Fatal(err)
+			}
+			numProduced += n
 		}
 
-		// TODO: Verify that Kafka does indeed perform log compaction per
-		// partition key (as opposed to some other type of "key"). The docs
-		// aren't exactly clear on this point.
-		key := ""
-		if id != nil {
-			key = id.(string)
+		if !conf.Daemon || ctx.Err() != nil {
+			break
+		}
+
+		// Back off while idle so that a quiet account isn't polled
+		// needlessly, but go back to the base interval as soon as there's
+		// something new.
+		if numProduced > 0 {
+			interval = conf.PollInterval
+		} else {
+			interval *= 2
+			if interval > conf.PollMaxInterval {
+				interval = conf.PollMaxInterval
+			}
 		}
 
-		message := &sarama.ProducerMessage{
-			Topic: topic,
-			Key:   sarama.StringEncoder(key),
-			Value: sarama.ByteEncoder(data),
+		log.Printf("Produced %v event(s). Polling again in %v.", numProduced, interval)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+}
+
+func processBatch(producer sarama.SyncProducer, topic, account string, events []*stripe.Event) error {
+	for _, event := range events {
+		wrapped, err := newEnvelope(event, account)
+		if err != nil {
+			return err
+		}
+
+		message, err := wrapped.Message(topic)
+		if err != nil {
+			return err
 		}
 
 		start := time.Now()
@@ -92,41 +194,138 @@ func processBatch(producer sarama.SyncProducer, topic string, events []*stripe.E
 	return nil
 }
 
-func tailLog(producer sarama.SyncProducer, topic string) error {
-	numProcessed := 0
+// Wraps an event in the envelope that it's produced in. Events for a
+// connected account are tagged with it so that they can be told apart from
+// those of the platform and other accounts.
+func newEnvelope(event *stripe.Event, account string) (*envelope.Envelope, error) {
+	var previousAttributes json.RawMessage
+	if event.Data.Prev != nil {
+		var err error
+		previousAttributes, err = json.Marshal(event.Data.Prev)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &envelope.Envelope{
+		Account: account,
+		Created: event.Created,
+		Data: envelope.Data{
+			Object:             event.Data.Raw,
+			PreviousAttributes: previousAttributes,
+		},
+		ID:       event.ID,
+		Livemode: event.Live,
+		Type:     event.Type,
+	}, nil
+}
 
+// Produces the account's events that are newer than its checkpoint in
+// chronological order, saving the checkpoint after each batch. Returns the
+// number of events produced, and stops early after the current batch if ctx
+// is cancelled.
+//
+// Stripe lists events newest first. With no checkpoint, every event is read
+// before any is produced so that the topic starts with the oldest one (Stripe
+// only keeps events for 30 days, which bounds how many there are). After
+// that, events are listed with `ending_before` the checkpoint, which the
+// iterator pages through from oldest to newest.
+func tailLog(ctx context.Context, producer sarama.SyncProducer, topic, account string, state *feederState) (int, error) {
 	params := &stripe.EventListParams{}
 	params.Filters.AddFilter("limit", "", strconv.Itoa(PageSize))
 
+	// Sent as the Stripe-Account header so that we get the connected
+	// account's events rather than the platform's.
+	params.StripeAccount = account
+
+	checkpoint := state.Checkpoints[account]
+	if checkpoint != "" {
+		log.Printf("Resuming after event %v", checkpoint)
+		params.End = checkpoint
+		iterator := event.List(params)
+		return feed(ctx, producer, topic, account, state, func() (*stripe.Event, error) {
+			if !iterator.Next() {
+				return nil, iterator.Err()
+			}
+			return iterator.Event(), nil
+		})
+	}
+
+	log.Printf("No checkpoint. Backfilling from the oldest event.")
+
+	// Nothing's been produced while reading, so there's nothing to finish
+	// if we're interrupted.
+	var events []*stripe.Event
 	iterator := event.List(params)
-	timeIterator := func() bool {
-		//start := time.Now()
-		ret := iterator.Next()
-		//log.Printf("API request took %v", time.Now().Sub(start))
-		return ret
+	for iterator.Next() {
+		if ctx.Err() != nil {
+			return 0, nil
+		}
+		events = append(events, iterator.Event())
+	}
+	if err := iterator.Err(); err != nil {
+		return 0, err
+	}
+
+	i := len(events)
+	return feed(ctx, producer, topic, account, state, func() (*stripe.Event, error) {
+		if i == 0 {
+			return nil, nil
+		}
+		i--
+		return events[i], nil
+	})
+}
+
+// Produces events from next in batches until it returns nil or ctx is
+// cancelled, saving the last event of each batch as the account's checkpoint
+// once Kafka has acknowledged it. Returns the number of events produced.
+func feed(ctx context.Context, producer sarama.SyncProducer, topic, account string, state *feederState, next func() (*stripe.Event, error)) (int, error) {
+	numBatches := 0
+	numProduced := 0
+
+	flush := func(batch []*stripe.Event) error {
+		err := processBatch(producer, topic, account, batch)
+		if err != nil {
+			return err
+		}
+		numProduced += len(batch)
+		return state.save(account, batch[len(batch)-1].ID)
 	}
 
 	var batch []*stripe.Event
-	for timeIterator() {
-		event := iterator.Event()
+	for ctx.Err() == nil {
+		event, err := next()
+		if err != nil {
+			return numProduced, err
+		}
+		if event == nil {
+			break
+		}
 
 		batch = append(batch, event)
 
 		if len(batch) == KafkaBatchSize {
-			err := processBatch(producer, topic, batch)
+			err := flush(batch)
 			if err != nil {
-				return err
+				return numProduced, err
 			}
 			batch = nil
 
-			numProcessed = numProcessed + 1
-			if numProcessed%ReportingIncrement == 0 {
+			numBatches = numBatches + 1
+			if numBatches%ReportingIncrement == 0 {
 				log.Printf("Working. Processed %v record(s).", ReportingIncrement)
 			}
 		}
 	}
-	if err := iterator.Err(); err != nil {
-		return err
+
+	// Flush the last partial batch so that it isn't lost before moving on to
+	// the next account or poll, or exiting.
+	if len(batch) > 0 {
+		err := flush(batch)
+		if err != nil {
+			return numProduced, err
+		}
 	}
-	return nil
+	return numProduced, nil
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// feederState is the checkpoint of each account that the feeder has
+// produced events for, persisted to a local file.
+type feederState struct {
+	path string
+
+	// Checkpoints maps each account (empty for the platform) to the ID of
+	// the newest event produced for it.
+	Checkpoints map[string]string `json:"checkpoints"`
+}
+
+// Loads the state from path, or returns an empty state if the file doesn't
+// exist yet.
+func loadState(path string) (*feederState, error) {
+	state := &feederState{path: path, Checkpoints: make(map[string]string)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Checkpoints == nil {
+		state.Checkpoints = make(map[string]string)
+	}
+	return state, nil
+}
+
+// Records a new checkpoint for an account and saves the state. The file is
+// written to a temporary path and renamed over the old one so that a crash
+// never leaves it half written.
+func (s *feederState) save(account, eventID string) error {
+	s.Checkpoints[account] = eventID
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
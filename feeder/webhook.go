@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stripe/stripe-go"
+)
+
+const (
+	// Maximum size of a webhook body that's accepted.
+	WebhookMaxBodySize = 1 << 20
+
+	// Number of recently produced event IDs remembered so that redelivered
+	// webhooks aren't produced again. The file they're persisted to is
+	// compacted once it's grown to twice this many.
+	WebhookSeenSize = 100000
+)
+
+// Serves Stripe webhook deliveries on conf.WebhookAddr until ctx is
+// cancelled, producing each event to Kafka in the same way as a polled one.
+// A delivery is acknowledged only after Kafka has acknowledged its event, so
+// anything that fails is retried by Stripe.
+func serveWebhooks(ctx context.Context, producer sarama.SyncProducer, conf Conf) error {
+	if conf.WebhookSecrets == "" {
+		return fmt.Errorf("WEBHOOK_SECRETS is required to receive webhooks")
+	}
+
+	seen, err := loadSeenEvents(conf.WebhookSeenPath, WebhookSeenSize)
+	if err != nil {
+		return err
+	}
+	defer seen.Close()
+
+	handler := &webhookHandler{
+		producer:  producer,
+		secrets:   strings.Split(conf.WebhookSecrets, ","),
+		seen:      seen,
+		tolerance: conf.WebhookTolerance,
+		topic:     conf.KafkaTopic,
+	}
+
+	server := &http.Server{Addr: conf.WebhookAddr, Handler: handler}
+
+	// Let deliveries that are being produced finish before exiting.
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	log.Printf("Receiving webhooks on %v", conf.WebhookAddr)
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+type webhookHandler struct {
+	producer  sarama.SyncProducer
+	secrets   []string
+	seen      *seenEvents
+	tolerance time.Duration
+	topic     string
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, WebhookMaxBodySize))
+	if err != nil {
+		http.Error(w, "Couldn't read body", http.StatusBadRequest)
+		return
+	}
+
+	err = verifySignature(payload, r.Header.Get("Stripe-Signature"), h.secrets,
+		h.tolerance, time.Now())
+	if err != nil {
+		log.Printf("Rejecting webhook: %v", err)
+		http.Error(w, "Bad signature", http.StatusBadRequest)
+		return
+	}
+
+	var event stripe.Event
+	err = json.Unmarshal(payload, &event)
+	if err != nil {
+		http.Error(w, "Couldn't decode event", http.StatusBadRequest)
+		return
+	}
+
+	// Stripe delivers an event at least once, so it may already have been
+	// produced. A redelivery mustn't be produced again, because the consumer
+	// can't tell that it's stale: it would be given a later sequence than
+	// anything produced in the meantime, so it would overwrite a newer
+	// version of its object that was created in the same second. Produced
+	// IDs are persisted so that this holds across restarts, and a delivery
+	// that arrives while another of the same event is still being produced
+	// is turned away for Stripe to retry.
+	if !h.seen.Claim(event.ID) {
+		if h.seen.Contains(event.ID) {
+			log.Printf("Skipping event %v that was already produced", event.ID)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Error(w, "Event is already being produced", http.StatusConflict)
+		return
+	}
+
+	// Events for connected accounts name the account in the payload.
+	var connect struct {
+		Account string `json:"account"`
+	}
+	err = json.Unmarshal(payload, &connect)
+	if err != nil {
+		h.seen.Release(event.ID)
+		http.Error(w, "Couldn't decode event", http.StatusBadRequest)
+		return
+	}
+
+	err = processBatch(h.producer, h.topic, connect.Account, []*stripe.Event{&event})
+	if err != nil {
+		h.seen.Release(event.ID)
+		log.Printf("Couldn't produce event %v: %v", event.ID, err)
+		http.Error(w, "Couldn't produce event", http.StatusInternalServerError)
+		return
+	}
+
+	// The event was produced, so acknowledge it even if it couldn't be
+	// persisted as seen. It's still remembered until the feeder restarts.
+	err = h.seen.Add(event.ID)
+	if err != nil {
+		log.Printf("Couldn't persist event %v as produced: %v", event.ID, err)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Checks a Stripe-Signature header against the payload. The header has a
+// timestamp and one or more signatures, like:
+//
+//	t=1492774577,v1=5257a869e7ecebeda32affa62cdca3fa51cad7e77a0e56ff536d0ce8e108d8bd
+//
+// Each signature is an HMAC-SHA256 of the timestamp and payload joined by a
+// period. It's valid if any signature matches any of the secrets (there may be
+// several while a secret is being rolled), and the timestamp is within
+// tolerance of now so that old deliveries can't be replayed.
+func verifySignature(payload []byte, header string, secrets []string, tolerance time.Duration, now time.Time) error {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		pieces := strings.SplitN(part, "=", 2)
+		if len(pieces) != 2 {
+			continue
+		}
+
+		switch pieces[0] {
+		case "t":
+			timestamp = pieces[1]
+		case "v1":
+			signature, err := hex.DecodeString(pieces[1])
+			if err != nil {
+				continue
+			}
+			signatures = append(signatures, signature)
+		}
+	}
+
+	if timestamp == "" || len(signatures) == 0 {
+		return fmt.Errorf("No timestamp or signatures in header")
+	}
+
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Bad timestamp: %v", timestamp)
+	}
+
+	age := now.Sub(time.Unix(t, 0))
+	if age > tolerance || age < -tolerance {
+		return fmt.Errorf("Timestamp outside of tolerance: %v", timestamp)
+	}
+
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp))
+		mac.Write([]byte("."))
+		mac.Write(payload)
+		expected := mac.Sum(nil)
+
+		for _, signature := range signatures {
+			if hmac.Equal(expected, signature) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("No signature matches")
+}
+
+// seenEvents remembers the IDs of the most recently produced events,
+// forgetting the oldest once it's full. Each ID is appended to a file as it's
+// added so that they're remembered across restarts, and the file is rewritten
+// with only the remembered IDs when it's loaded and once it's grown to twice
+// their number. IDs of events that are being produced are tracked separately
+// until they're either added or released.
+type seenEvents struct {
+	mutex    sync.Mutex
+	ids      map[string]bool
+	inFlight map[string]bool
+	order    []string
+	size     int
+
+	path     string
+	file     *os.File
+	numLines int
+}
+
+// Loads the IDs persisted at path, if any, and opens it to append to.
+func loadSeenEvents(path string, size int) (*seenEvents, error) {
+	s := &seenEvents{
+		ids:      make(map[string]bool),
+		inFlight: make(map[string]bool),
+		size:     size,
+		path:     path,
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// A crash may have left the last line half written, in which case it's
+	// not a whole ID.
+	lines := strings.Split(string(data), "\n")
+	for _, id := range lines[:len(lines)-1] {
+		if id != "" {
+			s.remember(id)
+		}
+	}
+
+	err = s.compact()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Claim reserves an event's ID before it's produced. It returns false if the
+// event was already produced or is being produced by another delivery.
+func (s *seenEvents) Claim(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ids[id] || s.inFlight[id] {
+		return false
+	}
+	s.inFlight[id] = true
+	return true
+}
+
+// Release gives up the claim on an event's ID that couldn't be produced so
+// that a redelivery can try again.
+func (s *seenEvents) Release(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.inFlight, id)
+}
+
+// Add records that an event was produced and persists its ID.
+func (s *seenEvents) Add(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.inFlight, id)
+	if s.ids[id] {
+		return nil
+	}
+	s.remember(id)
+
+	// The file is closed if compacting it failed last time.
+	if s.file == nil {
+		return s.compact()
+	}
+
+	_, err := s.file.WriteString(id + "\n")
+	if err != nil {
+		return err
+	}
+	err = s.file.Sync()
+	if err != nil {
+		return err
+	}
+	s.numLines++
+
+	if s.numLines >= 2*s.size {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *seenEvents) Contains(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ids[id]
+}
+
+func (s *seenEvents) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+func (s *seenEvents) remember(id string) {
+	if s.ids[id] {
+		return
+	}
+
+	if len(s.order) >= s.size {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+
+	s.ids[id] = true
+	s.order = append(s.order, id)
+}
+
+// Rewrites the file with only the remembered IDs and reopens it to append
+// to. Like the feeder's state, it's written to a temporary path and renamed
+// over the old one so that a crash never leaves it half written.
+func (s *seenEvents) compact() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var data []byte
+	for _, id := range s.order {
+		data = append(append(data, id...), '\n')
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return err
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.numLines = len(s.order)
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Signs a payload the way that Stripe does.
+func testSignature(payload []byte, timestamp int64, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%v.", timestamp)))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	payload := []byte(`{"id":"evt_123","object":"event"}`)
+	now := time.Unix(1500000000, 0)
+	timestamp := now.Unix()
+	secrets := []string{"whsec_new", "whsec_old"}
+	tolerance := 5 * time.Minute
+
+	valid := testSignature(payload, timestamp, "whsec_new")
+
+	testCases := []struct {
+		name    string
+		header  string
+		payload []byte
+		wantErr string
+	}{
+		{
+			name:   "Valid",
+			header: fmt.Sprintf("t=%v,v1=%v", timestamp, valid),
+		},
+		{
+			name:   "SignedWithOtherSecret",
+			header: fmt.Sprintf("t=%v,v1=%v", timestamp, testSignature(payload, timestamp, "whsec_old")),
+		},
+		{
+			name: "MultipleSignaturesOneMatching",
+			header: fmt.Sprintf("t=%v,v1=%v,v1=%v", timestamp,
+				testSignature(payload, timestamp, "whsec_unknown"), valid),
+		},
+		{
+			name:   "OtherSchemesIgnored",
+			header: fmt.Sprintf("t=%v,v0=%v,v1=%v", timestamp, "6ffbb59b2300aae63f272406069a9788598b792a944a07aba816edb039989a39", valid),
+		},
+		{
+			name:   "MalformedSignatureIgnored",
+			header: fmt.Sprintf("t=%v,v1=not-hex,v1=%v", timestamp, valid),
+		},
+		{
+			name:   "JustInsideTolerance",
+			header: fmt.Sprintf("t=%v,v1=%v", timestamp-300, testSignature(payload, timestamp-300, "whsec_new")),
+		},
+		{
+			name:    "TooOld",
+			header:  fmt.Sprintf("t=%v,v1=%v", timestamp-301, testSignature(payload, timestamp-301, "whsec_new")),
+			wantErr: fmt.Sprintf("Timestamp outside of tolerance: %v", timestamp-301),
+		},
+		{
+			name:    "TooFarInFuture",
+			header:  fmt.Sprintf("t=%v,v1=%v", timestamp+301, testSignature(payload, timestamp+301, "whsec_new")),
+			wantErr: fmt.Sprintf("Timestamp outside of tolerance: %v", timestamp+301),
+		},
+		{
+			name:    "BadSecret",
+			header:  fmt.Sprintf("t=%v,v1=%v", timestamp, testSignature(payload, timestamp, "whsec_unknown")),
+			wantErr: "No signature matches",
+		},
+		{
+			name:    "MultipleSignaturesNoneMatching",
+			header:  fmt.Sprintf("t=%v,v1=%v,v1=%v", timestamp, testSignature(payload, timestamp, "whsec_a"), testSignature(payload, timestamp, "whsec_b")),
+			wantErr: "No signature matches",
+		},
+		{
+			name:    "TamperedPayload",
+			header:  fmt.Sprintf("t=%v,v1=%v", timestamp, valid),
+			payload: []byte(`{"id":"evt_456","object":"event"}`),
+			wantErr: "No signature matches",
+		},
+		{
+			name:    "TimestampNotSigned",
+			header:  fmt.Sprintf("t=%v,v1=%v", timestamp+1, valid),
+			wantErr: "No signature matches",
+		},
+		{
+			name:    "NoTimestamp",
+			header:  fmt.Sprintf("v1=%v", valid),
+			wantErr: "No timestamp or signatures in header",
+		},
+		{
+			name:    "NoSignatures",
+			header:  fmt.Sprintf("t=%v", timestamp),
+			wantErr: "No timestamp or signatures in header",
+		},
+		{
+			name:    "OnlyMalformedSignatures",
+			header:  fmt.Sprintf("t=%v,v1=not-hex", timestamp),
+			wantErr: "No timestamp or signatures in header",
+		},
+		{
+			name:    "EmptyHeader",
+			header:  "",
+			wantErr: "No timestamp or signatures in header",
+		},
+		{
+			name:    "BadTimestamp",
+			header:  fmt.Sprintf("t=yesterday,v1=%v", valid),
+			wantErr: "Bad timestamp: yesterday",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			body := payload
+			if testCase.payload != nil {
+				body = testCase.payload
+			}
+
+			err := verifySignature(body, testCase.header, secrets, tolerance, now)
+
+			if testCase.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected a valid signature, got %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != testCase.wantErr {
+				t.Errorf("Expected error %q, got %v", testCase.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSeenEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.log")
+
+	seen, err := loadSeenEvents(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !seen.Claim("evt_1") {
+		t.Fatal("Expected to claim evt_1")
+	}
+	if seen.Claim("evt_1") {
+		t.Error("Expected evt_1 not to be claimed again while in flight")
+	}
+	if seen.Contains("evt_1") {
+		t.Error("Expected evt_1 not to be seen before it's added")
+	}
+
+	// A released claim can be made again by a redelivery.
+	seen.Release("evt_1")
+	if !seen.Claim("evt_1") {
+		t.Fatal("Expected to claim evt_1 after releasing it")
+	}
+
+	for _, id := range []string{"evt_1", "evt_2", "evt_3", "evt_4", "evt_5", "evt_6"} {
+		seen.Claim(id)
+		err = seen.Add(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seen.Claim("evt_6") {
+		t.Error("Expected evt_6 not to be claimed after it was added")
+	}
+
+	// The file was compacted to the remembered IDs once it reached twice
+	// their number.
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "evt_4\nevt_5\nevt_6\n" {
+		t.Errorf("Unexpected file contents: %q", data)
+	}
+
+	err = seen.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash partway through appending an ID.
+	err = ioutil.WriteFile(path, append(data, "evt_7"...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen, err = loadSeenEvents(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seen.Close()
+
+	var remembered []string
+	for _, id := range []string{"evt_3", "evt_4", "evt_5", "evt_6", "evt_7"} {
+		if seen.Contains(id) {
+			remembered = append(remembered, id)
+		}
+	}
+	if strings.Join(remembered, ",") != "evt_4,evt_5,evt_6" {
+		t.Errorf("Unexpected IDs remembered after reloading: %v", remembered)
+	}
+}
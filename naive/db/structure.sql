@@ -1,8 +1,6 @@
 BEGIN;
 
-DROP TABLE IF EXISTS charges;
-
-CREATE TABLE charges (
+CREATE TABLE IF NOT EXISTS charges (
     id text PRIMARY KEY,
     amount int,
     created TIMESTAMPTZ
@@ -0,0 +1,191 @@
+// Package redact removes or obscures personal information in Stripe objects
+// according to a policy of JSON paths. It's shared by the consumer, which
+// redacts objects before loading them, and the endpoint, which can redact
+// them before serving them.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Action is what's done to a value matched by a rule.
+type Action int
+
+const (
+	// Drop removes the value entirely. Items of an array are replaced with
+	// null so that the positions of the others don't change.
+	Drop Action = iota
+
+	// Hash replaces the value with a keyed HMAC of it so that it can still
+	// be counted and joined on, but not reversed by anyone without the key.
+	Hash
+
+	// Truncate cuts a string down to its first Rule.Length characters.
+	// Values that aren't strings are left alone.
+	Truncate
+)
+
+// Prefix of every hashed value so that it's obvious that it's been redacted.
+const HashPrefix = "hmac_"
+
+// Rule redacts the values at a path in an object.
+type Rule struct {
+	// Path is the keys leading to a value from the root of an object. A "*"
+	// matches any key of an object or any item of an array.
+	Path []string
+
+	Action Action
+
+	// Length is the number of characters kept by Truncate.
+	Length int
+}
+
+// Policy is a set of rules that are applied to every object.
+type Policy struct {
+	Rules []Rule
+
+	key []byte
+}
+
+// Parse parses a policy from a comma-separated list of rules, each a dotted
+// path and an action:
+//
+//	email=hash,shipping=drop,source.fingerprint=hash,description=truncate:8
+//
+// key is used to hash values, and is required if any rule hashes.
+func Parse(spec string, key []byte) (*Policy, error) {
+	policy := &Policy{key: key}
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		pieces := strings.SplitN(part, "=", 2)
+		if len(pieces) != 2 || pieces[0] == "" {
+			return nil, fmt.Errorf("Bad redaction rule (expected path=action): %v", part)
+		}
+
+		rule := Rule{Path: strings.Split(pieces[0], ".")}
+
+		action := pieces[1]
+		switch {
+		case action == "drop":
+			rule.Action = Drop
+
+		case action == "hash":
+			if len(key) == 0 {
+				return nil, fmt.Errorf("A key is required to hash values: %v", part)
+			}
+			rule.Action = Hash
+
+		case strings.HasPrefix(action, "truncate:"):
+			length, err := strconv.Atoi(strings.TrimPrefix(action, "truncate:"))
+			if err != nil || length < 0 {
+				return nil, fmt.Errorf("Bad truncation length: %v", part)
+			}
+			rule.Action = Truncate
+			rule.Length = length
+
+		default:
+			return nil, fmt.Errorf("Unknown redaction action: %v", part)
+		}
+
+		policy.Rules = append(policy.Rules, rule)
+	}
+
+	return policy, nil
+}
+
+// Apply redacts a decoded object in place.
+func (p *Policy) Apply(object map[string]interface{}) {
+	for _, rule := range p.Rules {
+		p.apply(object, rule.Path, rule)
+	}
+}
+
+func (p *Policy) apply(value interface{}, path []string, rule Rule) {
+	segment := path[0]
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if segment != "*" && segment != key {
+				continue
+			}
+
+			if len(path) > 1 {
+				p.apply(child, path[1:], rule)
+				continue
+			}
+
+			if rule.Action == Drop {
+				delete(v, key)
+			} else {
+				v[key] = p.redact(child, rule)
+			}
+		}
+
+	case []interface{}:
+		for i, child := range v {
+			if segment != "*" && segment != strconv.Itoa(i) {
+				continue
+			}
+
+			if len(path) > 1 {
+				p.apply(child, path[1:], rule)
+				continue
+			}
+
+			if rule.Action == Drop {
+				v[i] = nil
+			} else {
+				v[i] = p.redact(child, rule)
+			}
+		}
+	}
+}
+
+// Returns a value with a hashing or truncating rule applied.
+func (p *Policy) redact(value interface{}, rule Rule) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	switch rule.Action {
+	case Hash:
+		var data string
+		if s, ok := value.(string); ok {
+			data = s
+		} else {
+			// Hash anything else by its JSON so that equal values still
+			// hash the same.
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil
+			}
+			data = string(encoded)
+		}
+
+		mac := hmac.New(sha256.New, p.key)
+		mac.Write([]byte(data))
+		return HashPrefix + hex.EncodeToString(mac.Sum(nil))
+
+	case Truncate:
+		s, ok := value.(string)
+		if !ok || utf8.RuneCountInString(s) <= rule.Length {
+			return value
+		}
+		return string([]rune(s)[:rule.Length])
+	}
+
+	return value
+}
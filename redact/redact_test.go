@@ -0,0 +1,236 @@
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("secret")
+
+// Returns what a value is expected to hash to under the test key.
+func testHash(data string) string {
+	mac := hmac.New(sha256.New, testKey)
+	mac.Write([]byte(data))
+	return HashPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name    string
+		spec    string
+		key     []byte
+		want    []Rule
+		wantErr string
+	}{
+		{
+			name: "Empty",
+			spec: "",
+		},
+		{
+			name: "Actions",
+			spec: "email=hash,shipping=drop,description=truncate:8",
+			key:  testKey,
+			want: []Rule{
+				{Path: []string{"email"}, Action: Hash},
+				{Path: []string{"shipping"}, Action: Drop},
+				{Path: []string{"description"}, Action: Truncate, Length: 8},
+			},
+		},
+		{
+			name: "NestedPathsAndWhitespace",
+			spec: " source.fingerprint=hash , sources.data.*.name=drop,",
+			key:  testKey,
+			want: []Rule{
+				{Path: []string{"source", "fingerprint"}, Action: Hash},
+				{Path: []string{"sources", "data", "*", "name"}, Action: Drop},
+			},
+		},
+		{
+			name: "TruncateToNothing",
+			spec: "description=truncate:0",
+			want: []Rule{{Path: []string{"description"}, Action: Truncate, Length: 0}},
+		},
+		{
+			name: "DropWithoutKey",
+			spec: "email=drop",
+			want: []Rule{{Path: []string{"email"}, Action: Drop}},
+		},
+		{
+			name:    "HashWithoutKey",
+			spec:    "email=hash",
+			wantErr: "A key is required to hash values: email=hash",
+		},
+		{
+			name:    "MissingAction",
+			spec:    "email",
+			key:     testKey,
+			wantErr: "Bad redaction rule (expected path=action): email",
+		},
+		{
+			name:    "MissingPath",
+			spec:    "=drop",
+			wantErr: "Bad redaction rule (expected path=action): =drop",
+		},
+		{
+			name:    "UnknownAction",
+			spec:    "email=encrypt",
+			key:     testKey,
+			wantErr: "Unknown redaction action: email=encrypt",
+		},
+		{
+			name:    "BadTruncationLength",
+			spec:    "description=truncate:many",
+			wantErr: "Bad truncation length: description=truncate:many",
+		},
+		{
+			name:    "NegativeTruncationLength",
+			spec:    "description=truncate:-1",
+			wantErr: "Bad truncation length: description=truncate:-1",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			policy, err := Parse(testCase.spec, testCase.key)
+
+			if testCase.wantErr != "" {
+				if err == nil || err.Error() != testCase.wantErr {
+					t.Fatalf("Expected error %q, got %v", testCase.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(policy.Rules, testCase.want) {
+				t.Errorf("Expected rules %+v, got %+v", testCase.want, policy.Rules)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	testCases := []struct {
+		name   string
+		spec   string
+		object string
+		want   string
+	}{
+		{
+			name:   "Drop",
+			spec:   "email=drop",
+			object: `{"id":"cus_123","email":"jane@example.com"}`,
+			want:   `{"id":"cus_123"}`,
+		},
+		{
+			name:   "Hash",
+			spec:   "email=hash",
+			object: `{"id":"cus_123","email":"jane@example.com"}`,
+			want:   `{"id":"cus_123","email":"` + testHash("jane@example.com") + `"}`,
+		},
+		{
+			name:   "HashNonString",
+			spec:   "metadata=hash",
+			object: `{"metadata":{"b":2,"a":1}}`,
+			want:   `{"metadata":"` + testHash(`{"a":1,"b":2}`) + `"}`,
+		},
+		{
+			name:   "HashNull",
+			spec:   "email=hash",
+			object: `{"email":null}`,
+			want:   `{"email":null}`,
+		},
+		{
+			name:   "Truncate",
+			spec:   "description=truncate:4",
+			object: `{"description":"Jane Doe's order"}`,
+			want:   `{"description":"Jane"}`,
+		},
+		{
+			name:   "TruncateByCharacter",
+			spec:   "description=truncate:3",
+			object: `{"description":"Zoë Smith"}`,
+			want:   `{"description":"Zoë"}`,
+		},
+		{
+			name:   "TruncateShortOrNonString",
+			spec:   "description=truncate:8,amount=truncate:1",
+			object: `{"description":"Jane","amount":1000}`,
+			want:   `{"description":"Jane","amount":1000}`,
+		},
+		{
+			name:   "NestedPath",
+			spec:   "shipping.address.line1=drop,source.fingerprint=hash",
+			object: `{"shipping":{"name":"Jane","address":{"line1":"1 Main St","city":"Springfield"}},"source":{"fingerprint":"abc"}}`,
+			want:   `{"shipping":{"name":"Jane","address":{"city":"Springfield"}},"source":{"fingerprint":"` + testHash("abc") + `"}}`,
+		},
+		{
+			name:   "WildcardKey",
+			spec:   "metadata.*=drop",
+			object: `{"metadata":{"a":"1","b":"2"},"id":"ch_123"}`,
+			want:   `{"metadata":{},"id":"ch_123"}`,
+		},
+		{
+			name:   "WildcardArrayItems",
+			spec:   "sources.data.*.name=truncate:1",
+			object: `{"sources":{"data":[{"name":"Jane"},{"name":"John"},{"id":"card_123"}]}}`,
+			want:   `{"sources":{"data":[{"name":"J"},{"name":"J"},{"id":"card_123"}]}}`,
+		},
+		{
+			name:   "ArrayIndex",
+			spec:   "lines.1=drop",
+			object: `{"lines":["a","b","c"]}`,
+			want:   `{"lines":["a",null,"c"]}`,
+		},
+		{
+			name:   "MissingPath",
+			spec:   "shipping.address.line1=drop,email=hash",
+			object: `{"shipping":null,"id":"cus_123"}`,
+			want:   `{"shipping":null,"id":"cus_123"}`,
+		},
+		{
+			name:   "PathThroughScalar",
+			spec:   "customer.email=drop",
+			object: `{"customer":"cus_123"}`,
+			want:   `{"customer":"cus_123"}`,
+		},
+		{
+			name:   "RulesAppliedInOrder",
+			spec:   "email=truncate:4,email=hash",
+			object: `{"email":"jane@example.com"}`,
+			want:   `{"email":"` + testHash("jane") + `"}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			policy, err := Parse(testCase.spec, testKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var object, want map[string]interface{}
+			err = json.Unmarshal([]byte(testCase.object), &object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = json.Unmarshal([]byte(testCase.want), &want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			policy.Apply(object)
+
+			if !reflect.DeepEqual(object, want) {
+				got, _ := json.Marshal(object)
+				t.Errorf("Expected %v, got %s", strings.TrimSpace(testCase.want), got)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/Shopify/sarama"
+	"github.com/brandur/stripe-warehouse/envelope"
 	"github.com/joeshaw/envdecode"
 	_ "github.com/lib/pq"
 	"github.com/stripe/stripe-go"
@@ -29,7 +30,12 @@ func main() {
 		log.Fatal(err)
 	}
 
-	producer, err := sarama.NewSyncProducer(strings.Split(conf.SeedBroker, ","), nil)
+	// Headers need at least Kafka 0.11.
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_11_0_0
+	config.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(strings.Split(conf.SeedBroker, ","), config)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -49,32 +55,13 @@ func main() {
 // Note that unfortunately this does not actually produce in batches yet. We
 // should theoretically be able to with Kafka, but the sarama interface for a
 // `SyncProducer` currently seems overly limited.
-func processBatch(producer sarama.SyncProducer, topic string, events []*stripe.Event) error {
+func processBatch(producer sarama.SyncProducer, topic string, events []*envelope.Envelope) error {
 	for _, event := range events {
-		data, err := json.Marshal(event)
+		message, err := event.Message(topic)
 		if err != nil {
 			return err
 		}
 
-		id := event.Data.Obj["id"]
-		if id == nil {
-			log.Printf("Found event with nil data ID, type is %v", event.Type)
-		}
-
-		// TODO: Verify that Kafka does indeed perform log compaction per
-		// partition key (as opposed to some other type of "key"). The docs
-		// aren't exactly clear on this point.
-		key := ""
-		if id != nil {
-			key = id.(string)
-		}
-
-		message := &sarama.ProducerMessage{
-			Topic: topic,
-			Key:   sarama.StringEncoder(key),
-			Value: sarama.ByteEncoder(data),
-		}
-
 		//start := time.Now()
 		//partition, offset, err := producer.SendMessage(message)
 		_, _, err = producer.SendMessage(message)
@@ -90,7 +77,7 @@ func processBatch(producer sarama.SyncProducer, topic string, events []*stripe.E
 }
 
 func synthesizeEvents(producer sarama.SyncProducer, topic string, numEvents int) error {
-	var batch []*stripe.Event
+	var batch []*envelope.Envelope
 	for i := 0; i < numEvents; i++ {
 		charge := &stripe.Charge{
 			Amount:         9900,
@@ -108,21 +95,14 @@ func synthesizeEvents(producer sarama.SyncProducer, topic string, numEvents int)
 			return err
 		}
 
-		event := &stripe.Event{
+		event := &envelope.Envelope{
 			Created: 1454595354,
-			Data: &stripe.EventData{
-				// `Raw` is what's going to be sent over the wire here, but
-				// also populate `id` under `Obj` so the producer can select an
-				// appropriate key for it.
-				Obj: map[string]interface{}{
-					"id": charge.ID,
-				},
-				Raw: json.RawMessage(chargeData),
+			Data: envelope.Data{
+				Object: json.RawMessage(chargeData),
 			},
 			ID:       "evt_" + randomString(25),
-			Live:     false,
+			Livemode: false,
 			Type:     "charge.created",
-			Webhooks: 0,
 		}
 
 		batch = append(batch, event)